@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -8,10 +9,10 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"sort"
+	"regexp"
 	"strings"
 
-	"github.com/bazelbuild/buildtools/build"
+	"github.com/jayconrod/misc/internal/diff"
 )
 
 func main() {
@@ -23,28 +24,63 @@ func main() {
 	}
 }
 
+// run dispatches to a subcommand. The first argument names the subcommand;
+// if it's missing or is a flag, the subcommand is add.
+//
+//	add [-workspace_name ws] -repo X    copy X's BUILD files and add it to the manifest
+//	remove -repo X                      delete X's BUILD files and manifest entry
+//	sync [-workspace_name ws]           refresh every repository in the manifest
+//
+// Each subcommand runs in the root of the workspace containing the current
+// directory, or the directory named by -workspace_root.
 func run(args []string) error {
-	fs := flag.NewFlagSet("add-3p-repo", flag.ContinueOnError)
-	var workspaceName string
+	cmd := "add"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "add":
+		return runAdd(args)
+	case "remove":
+		return runRemove(args)
+	case "sync":
+		return runSync(args)
+	default:
+		return fmt.Errorf("unknown subcommand %q; expected add, remove, or sync", cmd)
+	}
+}
+
+func runAdd(args []string) error {
+	fs := flag.NewFlagSet("add-3p-repo add", flag.ContinueOnError)
+	var workspaceName, workspaceRoot string
 	var repo string
-	fs.StringVar(&workspaceName, "workspace_name", "", "name of the workspace")
+	var dryRun bool
+	var rules rewriteRules
+	fs.StringVar(&workspaceName, "workspace_name", "", "name of the workspace (default: the name in MODULE.bazel or WORKSPACE)")
+	fs.StringVar(&workspaceRoot, "workspace_root", "", "root directory of the workspace (default: the innermost directory containing the current directory with MODULE.bazel, WORKSPACE.bazel, or WORKSPACE)")
 	fs.StringVar(&repo, "repo", "", "repository to create third_party entry for")
+	fs.BoolVar(&dryRun, "dry_run", false, "print the BUILD files that would be copied and a diff of the manifest instead of changing anything")
+	fs.Var(&rules, "rewrite", "given as `old=new`, replace the label prefix old with new in labels, load paths, and visibility of copied BUILD files (may be repeated; the first matching rule applies). Rules are saved in third_party/<repo>/rewrites.txt and reused by sync and by later adds without -rewrite")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
 	if len(fs.Args()) != 0 {
 		return fmt.Errorf("expected 0 positional args; got %d", len(fs.Args()))
 	}
-	if workspaceName == "" {
-		return fmt.Errorf("-workspace_name was not set")
-	}
-	if repo == "" {
-		return fmt.Errorf("-repo was not set")
+	if err := checkRepoName(repo); err != nil {
+		return err
 	}
 
-	if err := cdToRoot(); err != nil {
+	if err := cdToRoot(workspaceRoot); err != nil {
 		return err
 	}
+	if workspaceName == "" {
+		var err error
+		workspaceName, err = workspaceNameFromRoot()
+		if err != nil {
+			return err
+		}
+	}
 
 	if err := fetch(repo); err != nil {
 		return err
@@ -60,54 +96,397 @@ func run(args []string) error {
 		return err
 	}
 
-	if err := copyBuildFilesToThirdParty(repo, repoDir, buildPaths); err != nil {
+	// Update the manifest before copying files, so that if the manifest
+	// can't be updated, nothing changes.
+	m, err := readManifest()
+	if err != nil {
+		return err
+	}
+	if err := m.setRepo(workspaceName, repo, buildRelPaths(repoDir, buildPaths)); err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		rules, err = readRewriteRules(repo)
+		if err != nil {
+			return err
+		}
+	}
+
+	conflicts, err := copyBuildFilesToThirdParty(repo, repoDir, buildPaths, rules, dryRun)
+	if err != nil {
+		return err
+	}
+	if err := writeRewriteRules(repo, rules, dryRun); err != nil {
 		return err
 	}
 
-	if err := updateManifest(workspaceName, repo, repoDir, buildPaths); err != nil {
+	if err := m.write(dryRun); err != nil {
 		return err
 	}
 
+	if err := writeOverlayFiles(dryRun); err != nil {
+		return err
+	}
+
+	return conflictError(conflicts)
+}
+
+// repoNameRE matches valid repository names. Besides letters, digits, and
+// the characters allowed in apparent names, '~' and '+' are allowed for
+// Bzlmod canonical names.
+var repoNameRE = regexp.MustCompile(`^[A-Za-z0-9_.~+-]+$`)
+
+// checkRepoName returns an error if repo isn't a valid repository name.
+// Repository names are used as directory names in third_party, so this
+// also keeps add and remove from touching files outside third_party/<repo>.
+func checkRepoName(repo string) error {
+	if repo == "" {
+		return fmt.Errorf("-repo was not set")
+	}
+	if !repoNameRE.MatchString(repo) || repo == "." || repo == ".." {
+		return fmt.Errorf("invalid repository name %q", repo)
+	}
 	return nil
 }
 
-func cdToRoot() error {
-	dir, err := filepath.Abs(".")
-	if err != nil {
+// conflictError returns an error if any BUILD files had merge conflicts.
+func conflictError(conflicts int) error {
+	if conflicts == 0 {
 		return nil
 	}
-	for {
-		if _, err := os.Stat(filepath.Join(dir, "WORKSPACE")); err == nil {
-			break
+	return fmt.Errorf("%d BUILD file(s) could not be merged with local edits; resolve conflicts, then replace .orig files with .upstream files", conflicts)
+}
+
+func runRemove(args []string) error {
+	fs := flag.NewFlagSet("add-3p-repo remove", flag.ContinueOnError)
+	var repo, workspaceRoot string
+	var dryRun bool
+	fs.StringVar(&repo, "repo", "", "repository to remove third_party entry for")
+	fs.StringVar(&workspaceRoot, "workspace_root", "", "root directory of the workspace (default: found from the current directory, as in add)")
+	fs.BoolVar(&dryRun, "dry_run", false, "print the directory that would be deleted and a diff of the manifest instead of changing anything")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(fs.Args()) != 0 {
+		return fmt.Errorf("expected 0 positional args; got %d", len(fs.Args()))
+	}
+	if err := checkRepoName(repo); err != nil {
+		return err
+	}
+
+	if err := cdToRoot(workspaceRoot); err != nil {
+		return err
+	}
+
+	m, err := readManifest()
+	if err != nil {
+		return err
+	}
+	thirdPartyDir := filepath.Join("third_party", repo)
+	_, statErr := os.Stat(thirdPartyDir)
+	if !m.removeRepo(repo) && os.IsNotExist(statErr) {
+		return fmt.Errorf("repository %s is not in %s", repo, m.path)
+	}
+	if dryRun {
+		fmt.Printf("delete %s\n", thirdPartyDir)
+	} else if err := os.RemoveAll(thirdPartyDir); err != nil {
+		return err
+	}
+	return m.write(dryRun)
+}
+
+func runSync(args []string) error {
+	fs := flag.NewFlagSet("add-3p-repo sync", flag.ContinueOnError)
+	var workspaceName, workspaceRoot string
+	var dryRun bool
+	fs.StringVar(&workspaceName, "workspace_name", "", "name of the workspace (default: the name used in existing manifest labels, or the name in MODULE.bazel or WORKSPACE)")
+	fs.StringVar(&workspaceRoot, "workspace_root", "", "root directory of the workspace (default: found from the current directory, as in add)")
+	fs.BoolVar(&dryRun, "dry_run", false, "print the changes that would be made instead of making them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(fs.Args()) != 0 {
+		return fmt.Errorf("expected 0 positional args; got %d", len(fs.Args()))
+	}
+
+	if err := cdToRoot(workspaceRoot); err != nil {
+		return err
+	}
+
+	m, err := readManifest()
+	if err != nil {
+		return err
+	}
+	if workspaceName == "" {
+		workspaceName = m.workspaceName()
+	}
+	if workspaceName == "" {
+		workspaceName, err = workspaceNameFromRoot()
+		if err != nil {
+			return err
 		}
-		if strings.HasSuffix(dir, string(os.PathSeparator)) {
-			return fmt.Errorf("could not locate WORKSPACE in any parent directory")
+	}
+
+	// Fetch every repository before changing anything, so that if one can't
+	// be fetched, nothing changes.
+	var plans []*syncPlan
+	for _, repo := range m.repos() {
+		p, err := planSync(m, repo)
+		if err != nil {
+			return err
 		}
-		dir = filepath.Dir(dir)
+		plans = append(plans, p)
 	}
-	return os.Chdir(dir)
+	conflicts := 0
+	for _, p := range plans {
+		repoConflicts, err := syncRepo(m, workspaceName, p, dryRun)
+		if err != nil {
+			return err
+		}
+		conflicts += repoConflicts
+	}
+	if dryRun {
+		// syncRepo writes the manifest after each repository. In dry-run
+		// mode, print one diff for all of them instead.
+		if err := m.write(dryRun); err != nil {
+			return err
+		}
+	}
+	if err := writeOverlayFiles(dryRun); err != nil {
+		return err
+	}
+	return conflictError(conflicts)
 }
 
+// fetch makes bazel download repo. The whole repository is fetched rather
+// than a target in it, since the repository may not have a root package.
 func fetch(repo string) error {
-	cmd := exec.Command("bazel", "fetch", "@"+repo+"//:BUILD.bazel")
+	label := repoLabel(repo)
+	cmd := exec.Command("bazel", "fetch", "--repo="+label)
+	stderr := &bytes.Buffer{}
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Run()
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("fetching %s: %v\n%s", label, err, bytes.TrimSpace(stderr.Bytes()))
+	}
 	return nil
 }
 
+// repoLabel returns the label bazel uses for repo: @@ followed by the name
+// for a canonical Bzlmod name like rules_go~0.41.0, or @ followed by the
+// name for an apparent name like rules_go.
+func repoLabel(repo string) string {
+	if strings.ContainsAny(repo, "~+") {
+		return "@@" + repo
+	}
+	return "@" + repo
+}
+
+// bazelInfo returns the value of a key printed by 'bazel info'.
+func bazelInfo(key string) (string, error) {
+	cmd := exec.Command("bazel", "info", key)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("bazel info %s: %v\n%s", key, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// findRepoDir returns the directory where bazel fetched repo, within the
+// external directory of the output base.
+//
+// With Bzlmod, directories are named after canonical repository names
+// rather than the apparent name used in WORKSPACE or MODULE.bazel, for
+// example "rules_go~0.41.0" or "gazelle~~go_deps~org_golang_x_mod" (or with
+// '+' separators in Bazel 8). If there's no directory named repo, findRepoDir
+// looks for a unique module repository named repo, then for a unique
+// repository named repo created by a module extension. Module repositories
+// come first so that -repo rules_go finds rules_go itself, not a repository
+// another module's extension happens to call rules_go.
 func findRepoDir(repo string) (string, error) {
-	externalPath := strings.Join([]string{"bazel-out", "..", "..", "..", "external", repo}, string(os.PathSeparator))
-	cleanPath, err := filepath.EvalSymlinks(externalPath)
+	outputBase, err := bazelInfo("output_base")
 	if err != nil {
 		return "", err
 	}
-	if st, err := os.Stat(cleanPath); err != nil {
+	externalDir := filepath.Join(outputBase, "external")
+	repoDir := filepath.Join(externalDir, repo)
+	if st, err := os.Stat(repoDir); err == nil && st.IsDir() {
+		return repoDir, nil
+	}
+
+	infos, err := ioutil.ReadDir(externalDir)
+	if err != nil {
 		return "", err
-	} else if !st.IsDir() {
-		return "", fmt.Errorf("%s: not a directory", externalPath)
 	}
-	return cleanPath, nil
+	var moduleMatches, extensionMatches []string
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		if isModuleRepoName(info.Name(), repo) {
+			moduleMatches = append(moduleMatches, info.Name())
+		} else if isExtensionRepoName(info.Name(), repo) {
+			extensionMatches = append(extensionMatches, info.Name())
+		}
+	}
+	matches := moduleMatches
+	if len(matches) == 0 {
+		matches = extensionMatches
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("repository @%s not found in %s", repo, externalDir)
+	case 1:
+		return filepath.Join(externalDir, matches[0]), nil
+	default:
+		return "", fmt.Errorf("repository @%s is ambiguous; it could be any of %s", repo, strings.Join(matches, ", "))
+	}
+}
+
+// isModuleRepoName reports whether name is the Bzlmod canonical name of the
+// repository for a module named repo, like "rules_go~0.41.0", "rules_go~",
+// or "rules_go+".
+func isModuleRepoName(name, repo string) bool {
+	parts := canonicalRepoNameParts(name)
+	return len(parts) == 2 && parts[0] == repo
+}
+
+// isExtensionRepoName reports whether name is the Bzlmod canonical name of
+// a repository named repo created by a module extension, like
+// "rules_go~~go_sdk~go_sdk" or "gazelle++go_deps+org_golang_x_mod".
+func isExtensionRepoName(name, repo string) bool {
+	parts := canonicalRepoNameParts(name)
+	return len(parts) > 2 && parts[len(parts)-1] == repo
+}
+
+// canonicalRepoNameParts splits a canonical repository name at its '~' or
+// '+' separators. Empty parts, like omitted versions, are kept. It returns
+// nil if name has no separators.
+func canonicalRepoNameParts(name string) []string {
+	if !strings.ContainsAny(name, "~+") {
+		return nil
+	}
+	return strings.Split(strings.ReplaceAll(name, "+", "~"), "~")
+}
+
+// A syncPlan holds what sync needs to know about a repository in the
+// manifest, collected before anything is changed.
+type syncPlan struct {
+	repo, repoDir string
+
+	// buildPaths are the paths of BUILD files in repoDir, and relPaths are
+	// the same paths relative to repoDir, slash-separated.
+	buildPaths, relPaths []string
+
+	// localPaths are the slash-separated paths of BUILD files with .in files
+	// in third_party/<repo>, without the .in suffix.
+	localPaths []string
+
+	// rules are the rewrite rules saved when the repository was added.
+	rules rewriteRules
+}
+
+// planSync re-fetches repo and finds its BUILD files, the .in files
+// already in third_party, and its saved rewrite rules. It returns an error
+// if repo's entry in m can't be updated.
+func planSync(m *manifest, repo string) (p *syncPlan, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("syncing %s: %w", repo, err)
+		}
+	}()
+
+	if err := checkRepoName(repo); err != nil {
+		return nil, err
+	}
+	if _, _, err := m.repoEntry(repo); err != nil {
+		return nil, err
+	}
+	if err := fetch(repo); err != nil {
+		return nil, err
+	}
+	p = &syncPlan{repo: repo}
+	p.repoDir, err = findRepoDir(repo)
+	if err != nil {
+		return nil, err
+	}
+	p.buildPaths, err = findBuildFiles(p.repoDir)
+	if err != nil {
+		return nil, err
+	}
+	p.relPaths = buildRelPaths(p.repoDir, p.buildPaths)
+	p.localPaths, err = findInFiles(filepath.Join("third_party", repo))
+	if err != nil {
+		return nil, err
+	}
+	p.rules, err = readRewriteRules(repo)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// syncRepo updates the .in files in third_party/<repo> to match the
+// repository's BUILD files with copyBuildFilesToThirdParty, applying its
+// saved rewrite rules, updates its entry in m, and deletes .in files for
+// BUILD files that no longer exist, along with their .orig and .upstream
+// files and directories left empty. Unless dryRun is set, the manifest is
+// written after new files are copied and before old files are deleted, so
+// if syncRepo fails, the manifest still only refers to files that exist.
+// syncRepo returns the number of files with conflicts.
+func syncRepo(m *manifest, workspaceName string, p *syncPlan, dryRun bool) (conflicts int, err error) {
+	repo := p.repo
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("syncing %s: %w", repo, err)
+		}
+	}()
+
+	conflicts, err = copyBuildFilesToThirdParty(repo, p.repoDir, p.buildPaths, p.rules, dryRun)
+	if err != nil {
+		return 0, err
+	}
+	if err := m.setRepo(workspaceName, repo, p.relPaths); err != nil {
+		return 0, err
+	}
+	if !dryRun {
+		if err := m.write(false); err != nil {
+			return 0, err
+		}
+	}
+
+	thirdPartyDir := filepath.Join("third_party", repo)
+	upstream := make(map[string]bool)
+	for _, rel := range p.relPaths {
+		upstream[rel] = true
+	}
+	for _, rel := range p.localPaths {
+		if upstream[rel] {
+			continue
+		}
+		fmt.Printf("%s: delete %s\n", repo, rel)
+		if !dryRun {
+			inPath := filepath.Join(thirdPartyDir, filepath.FromSlash(rel)+".in")
+			if err := os.Remove(inPath); err != nil {
+				return 0, err
+			}
+			for _, extra := range []string{origPath(inPath), upstreamPath(inPath)} {
+				if err := os.Remove(extra); err != nil && !os.IsNotExist(err) {
+					return 0, err
+				}
+			}
+			// Remove directories left empty. os.Remove fails on the first
+			// directory that isn't.
+			for dir := filepath.Dir(inPath); dir != thirdPartyDir; dir = filepath.Dir(dir) {
+				if os.Remove(dir) != nil {
+					break
+				}
+			}
+		}
+	}
+	return conflicts, nil
 }
 
 func findBuildFiles(repoDir string) ([]string, error) {
@@ -128,116 +507,155 @@ func findBuildFiles(repoDir string) ([]string, error) {
 	return files, nil
 }
 
-func copyBuildFilesToThirdParty(repo string, repoDir string, buildPaths []string) error {
-	thirdPartyDir := filepath.Join("third_party", repo)
-	if err := os.MkdirAll(thirdPartyDir, 0777); err != nil {
-		return err
-	}
-	for _, from := range buildPaths {
-		rel, _ := filepath.Rel(repoDir, from)
-		to := filepath.Join(thirdPartyDir, rel+".in")
-		if err := os.MkdirAll(filepath.Dir(to), 0777); err != nil {
-			return err
-		}
-		content, err := ioutil.ReadFile(from)
+// findInFiles returns the slash-separated paths of BUILD files with .in
+// files in dir, without the .in suffix.
+func findInFiles(dir string) ([]string, error) {
+	var relPaths []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if err := ioutil.WriteFile(to, content, 0666); err != nil {
+		if base := filepath.Base(path); base != "BUILD.bazel.in" && base != "BUILD.in" {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
 			return err
 		}
+		relPaths = append(relPaths, strings.TrimSuffix(filepath.ToSlash(rel), ".in"))
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
 	}
-	return nil
+	return relPaths, nil
 }
 
-func updateManifest(workspaceName, repo, repoDir string, buildPaths []string) error {
-	manifestPath := filepath.Join("third_party", "manifest.bzl")
-	var file *build.File
-	var manifestDict *build.DictExpr
-	if content, err := ioutil.ReadFile(manifestPath); err != nil {
-		manifestDict = &build.DictExpr{
-			ForceMultiLine: true,
-		}
+// buildRelPaths returns the slash-separated paths of BUILD files in
+// buildPaths relative to repoDir.
+func buildRelPaths(repoDir string, buildPaths []string) []string {
+	relPaths := make([]string, 0, len(buildPaths))
+	for _, buildPath := range buildPaths {
+		rel, _ := filepath.Rel(repoDir, buildPath)
+		relPaths = append(relPaths, filepath.ToSlash(rel))
+	}
+	return relPaths
+}
 
-		file = &build.File{
-			Path: manifestPath,
-			Stmt: []build.Expr{
-				&build.BinaryExpr{
-					X:  &build.LiteralExpr{Token: "manifest"},
-					Op: "=",
-					Y:  manifestDict,
-				},
-			},
-		}
-	} else {
-		file, err = build.Parse(manifestPath, content)
+// copyBuildFilesToThirdParty copies each BUILD file in buildPaths to a .in
+// file in third_party/<repo> with updateInFile, printing a line for each
+// file that's added or changed. Labels in copied files are rewritten with
+// rules. If dryRun is set, nothing is written. copyBuildFilesToThirdParty
+// returns the number of files with conflicts.
+func copyBuildFilesToThirdParty(repo string, repoDir string, buildPaths []string, rules rewriteRules, dryRun bool) (conflicts int, err error) {
+	thirdPartyDir := filepath.Join("third_party", repo)
+	for _, from := range buildPaths {
+		rel, _ := filepath.Rel(repoDir, from)
+		to := filepath.Join(thirdPartyDir, rel+".in")
+		status, err := updateInFile(from, to, rules, dryRun)
 		if err != nil {
-			return err
-		}
-		if len(file.Stmt) == 0 {
-			return fmt.Errorf("%s: manifest is empty", manifestPath)
+			return conflicts, err
 		}
-		manifestStmt, ok := file.Stmt[0].(*build.BinaryExpr)
-		if !ok || manifestStmt.Op != "=" {
-			return fmt.Errorf("%s: first statement is not assignment", manifestPath)
-		}
-		if lit, ok := manifestStmt.X.(*build.LiteralExpr); !ok || lit.Token != "manifest" {
-			return fmt.Errorf("%s: first statement is not assignment to manifest", manifestPath)
-		}
-		manifestDict, ok = manifestStmt.Y.(*build.DictExpr)
-		if !ok {
-			return fmt.Errorf("%s: first statement is not dict assignment", manifestPath)
+		switch status {
+		case "":
+		case "conflict":
+			conflicts++
+			fmt.Printf("%s: conflict in %s; upstream version is in %s\n", repo, to, upstreamPath(to))
+		default:
+			fmt.Printf("%s: %s %s\n", repo, status, filepath.ToSlash(rel))
 		}
 	}
+	return conflicts, nil
+}
 
-	entries := make([]build.Expr, 0, len(buildPaths))
-	for _, buildPath := range buildPaths {
-		value, _ := filepath.Rel(repoDir, buildPath)
-		value = filepath.ToSlash(value)
-		key := fmt.Sprintf("@%s//third_party:%s/%s.in", workspaceName, repo, value)
-		entry := &build.KeyValueExpr{
-			Key:   &build.StringExpr{Value: key},
-			Value: &build.StringExpr{Value: value},
-		}
-		entries = append(entries, entry)
-	}
-
-	repoEntry := &build.KeyValueExpr{
-		Key: &build.StringExpr{Value: repo},
-		Value: &build.DictExpr{
-			List:           entries,
-			ForceMultiLine: true,
-		},
-	}
-	replacedEntry := false
-	for i, entry := range manifestDict.List {
-		kv := entry.(*build.KeyValueExpr)
-		key, ok := kv.Key.(*build.StringExpr)
+// updateInFile updates the .in file at to with the upstream BUILD file at
+// from, preserving local edits. Labels in the upstream file are rewritten
+// with rules first, so the .orig file holds the rewritten upstream file.
+//
+// A pristine copy of the upstream file is kept next to the .in file, with
+// the .in suffix replaced by .orig. When the upstream file changes, the
+// changes between the .orig file and the new upstream file are merged into
+// the .in file. If the merge conflicts, or if the .in file differs from
+// upstream but there's no .orig file to merge from, the .in and .orig files
+// are left alone, and the new upstream file is written with a .upstream
+// suffix. After resolving the conflict, the .upstream file should replace
+// the .orig file.
+//
+// updateInFile returns "add" if the .in file was created, "update" if it
+// was replaced with the new upstream file, "merge" if upstream changes were
+// merged with local edits, "conflict", or "" if nothing changed.
+func updateInFile(from, to string, rules rewriteRules, dryRun bool) (status string, err error) {
+	upstream, err := ioutil.ReadFile(from)
+	if err != nil {
+		return "", err
+	}
+	upstream, err = rules.rewrite(from, upstream)
+	if err != nil {
+		return "", err
+	}
+	local, err := ioutil.ReadFile(to)
+	if os.IsNotExist(err) {
+		local = nil
+	} else if err != nil {
+		return "", err
+	}
+	origPath := origPath(to)
+	base, err := ioutil.ReadFile(origPath)
+	hasBase := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	newLocal := local
+	switch {
+	case local == nil:
+		status, newLocal = "add", upstream
+	case bytes.Equal(local, upstream):
+	case hasBase && bytes.Equal(base, upstream):
+		// Only local edits.
+	case hasBase && bytes.Equal(local, base):
+		status, newLocal = "update", upstream
+	case hasBase:
+		merged, ok := diff.Merge3(base, local, upstream)
 		if !ok {
-			continue
-		}
-		if key.Value == repo {
-			manifestDict.List[i] = repoEntry
-			replacedEntry = true
-			break
+			status = "conflict"
+		} else {
+			status, newLocal = "merge", merged
 		}
+	default:
+		status = "conflict"
 	}
-	if !replacedEntry {
-		manifestDict.List = append(manifestDict.List, repoEntry)
+	if dryRun {
+		return status, nil
 	}
 
-	stringKey := func(entry build.Expr) string {
-		key, ok := entry.(*build.KeyValueExpr).Key.(*build.StringExpr)
-		if !ok {
-			fmt.Fprintf(os.Stderr, "no string?\n")
-			return ""
+	if status == "conflict" {
+		return status, ioutil.WriteFile(upstreamPath(to), upstream, 0666)
+	}
+	if status != "" {
+		if err := os.MkdirAll(filepath.Dir(to), 0777); err != nil {
+			return "", err
+		}
+		if err := ioutil.WriteFile(to, newLocal, 0666); err != nil {
+			return "", err
 		}
-		return key.Value
 	}
-	sort.Slice(manifestDict.List, func(i, j int) bool {
-		return stringKey(manifestDict.List[i]) < stringKey(manifestDict.List[j])
-	})
+	if !hasBase || !bytes.Equal(base, upstream) {
+		if err := ioutil.WriteFile(origPath, upstream, 0666); err != nil {
+			return "", err
+		}
+	}
+	// A .upstream file left by an earlier conflict is stale now.
+	if err := os.Remove(upstreamPath(to)); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	return status, nil
+}
+
+func origPath(inPath string) string {
+	return strings.TrimSuffix(inPath, ".in") + ".orig"
+}
 
-	content := build.Format(file)
-	return ioutil.WriteFile(file.Path, content, 0666)
+func upstreamPath(inPath string) string {
+	return strings.TrimSuffix(inPath, ".in") + ".upstream"
 }
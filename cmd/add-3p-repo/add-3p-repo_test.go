@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalRepoName(t *testing.T) {
+	for _, tt := range []struct {
+		name                string
+		wantModule, wantExt bool
+	}{
+		{name: "rules_go~0.41.0", wantModule: true},
+		{name: "rules_go~", wantModule: true},
+		{name: "rules_go+", wantModule: true},
+		{name: "rules_go~~go_sdk~go_sdk"},
+		{name: "rules_go++go_sdk+go_sdk"},
+		{name: "rules_go~0.41.0~go_sdk~go_sdk"},
+		{name: "gazelle~~go_deps~rules_go", wantExt: true},
+		{name: "gazelle++go_deps+rules_go", wantExt: true},
+		{name: "rules_go"},
+		{name: "rules_go_extra~1.0"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isModuleRepoName(tt.name, "rules_go"); got != tt.wantModule {
+				t.Errorf("isModuleRepoName: got %v; want %v", got, tt.wantModule)
+			}
+			if got := isExtensionRepoName(tt.name, "rules_go"); got != tt.wantExt {
+				t.Errorf("isExtensionRepoName: got %v; want %v", got, tt.wantExt)
+			}
+		})
+	}
+}
+
+func TestRepoLabel(t *testing.T) {
+	for _, tt := range []struct {
+		repo, want string
+	}{
+		{repo: "rules_go", want: "@rules_go"},
+		{repo: "rules_go~0.41.0", want: "@@rules_go~0.41.0"},
+		{repo: "rules_go+", want: "@@rules_go+"},
+		{repo: "gazelle~~go_deps~org_golang_x_mod", want: "@@gazelle~~go_deps~org_golang_x_mod"},
+	} {
+		if got := repoLabel(tt.repo); got != tt.want {
+			t.Errorf("repoLabel(%q): got %q; want %q", tt.repo, got, tt.want)
+		}
+	}
+}
+
+func TestSyncRepoDeletes(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dryRun=%v", dryRun), func(t *testing.T) {
+			dir := chdirTemp(t)
+			repoDir := filepath.Join(dir, "external", "rules_foo~1.0")
+			writeFiles(t, dir, map[string]string{
+				"external/rules_foo~1.0/BUILD.bazel":   "# root\n",
+				"external/rules_foo~1.0/a/BUILD.bazel": "# a\n",
+
+				"third_party/rules_foo/BUILD.bazel.in":   "# root\n",
+				"third_party/rules_foo/BUILD.bazel.orig": "# root\n",
+				"third_party/rules_foo/rewrites.txt":     rewriteRulesHeader,
+
+				// Gone upstream, in a directory left empty.
+				"third_party/rules_foo/old/sub/BUILD.in":       "# old\n",
+				"third_party/rules_foo/old/sub/BUILD.orig":     "# old\n",
+				"third_party/rules_foo/old/sub/BUILD.upstream": "# old\n",
+
+				// Gone upstream, in a directory with other files.
+				"third_party/rules_foo/gone/BUILD.bazel.in": "# gone\n",
+				"third_party/rules_foo/gone/README":         "keep\n",
+			})
+			m, err := parseManifest(filepath.Join("third_party", "manifest.bzl"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := m.setRepo("ws", "rules_foo", []string{"BUILD.bazel", "gone/BUILD.bazel", "old/sub/BUILD"}); err != nil {
+				t.Fatal(err)
+			}
+			p := &syncPlan{
+				repo:       "rules_foo",
+				repoDir:    repoDir,
+				buildPaths: []string{filepath.Join(repoDir, "BUILD.bazel"), filepath.Join(repoDir, "a", "BUILD.bazel")},
+				relPaths:   []string{"BUILD.bazel", "a/BUILD.bazel"},
+				localPaths: []string{"BUILD.bazel", "gone/BUILD.bazel", "old/sub/BUILD"},
+			}
+			conflicts, err := syncRepo(m, "ws", p, dryRun)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conflicts != 0 {
+				t.Errorf("got %d conflicts; want 0", conflicts)
+			}
+
+			want := []string{
+				"third_party/rules_foo/",
+				"third_party/rules_foo/BUILD.bazel.in",
+				"third_party/rules_foo/BUILD.bazel.orig",
+				"third_party/rules_foo/a/",
+				"third_party/rules_foo/a/BUILD.bazel.in",
+				"third_party/rules_foo/a/BUILD.bazel.orig",
+				"third_party/rules_foo/gone/",
+				"third_party/rules_foo/gone/README",
+				"third_party/rules_foo/rewrites.txt",
+			}
+			if dryRun {
+				want = []string{
+					"third_party/rules_foo/",
+					"third_party/rules_foo/BUILD.bazel.in",
+					"third_party/rules_foo/BUILD.bazel.orig",
+					"third_party/rules_foo/gone/",
+					"third_party/rules_foo/gone/BUILD.bazel.in",
+					"third_party/rules_foo/gone/README",
+					"third_party/rules_foo/old/",
+					"third_party/rules_foo/old/sub/",
+					"third_party/rules_foo/old/sub/BUILD.in",
+					"third_party/rules_foo/old/sub/BUILD.orig",
+					"third_party/rules_foo/old/sub/BUILD.upstream",
+					"third_party/rules_foo/rewrites.txt",
+				}
+			}
+			if got := listFiles(t, filepath.Join(dir, "third_party", "rules_foo"), "third_party/rules_foo"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("got files:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+
+			manifest, err := ioutil.ReadFile(filepath.Join("third_party", "manifest.bzl"))
+			if dryRun {
+				if err == nil {
+					t.Errorf("dry run wrote manifest:\n%s", manifest)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(manifest), "rules_foo/a/BUILD.bazel.in") || strings.Contains(string(manifest), "gone") || strings.Contains(string(manifest), "old") {
+				t.Errorf("manifest does not match upstream BUILD files:\n%s", manifest)
+			}
+		})
+	}
+}
+
+// chdirTemp changes to a new temporary directory for the rest of the test,
+// since add-3p-repo works relative to the workspace root.
+func chdirTemp(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+// writeFiles writes files with slash-separated names relative to dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// listFiles returns the files and directories in dir, named with prefix
+// instead of dir, in lexical order. Directory names end with a slash.
+func listFiles(t *testing.T, dir, prefix string) []string {
+	t.Helper()
+	var names []string
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join(prefix, filepath.ToSlash(rel))
+		if fi.IsDir() {
+			name += "/"
+		}
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestUpdateInFile(t *testing.T) {
+	const (
+		base     = "a\nb\nc\n"
+		upstream = "a\nb\nC\n"
+		local    = "A\nb\nc\n"
+		merged   = "A\nb\nC\n"
+		conflict = "a\nb\nX\n"
+	)
+	for _, tt := range []struct {
+		desc       string
+		files      map[string]string // in the third_party directory
+		wantStatus string
+		wantFiles  map[string]string
+	}{
+		{
+			desc:       "add",
+			files:      map[string]string{},
+			wantStatus: "add",
+			wantFiles:  map[string]string{"BUILD.in": upstream, "BUILD.orig": upstream},
+		},
+		{
+			desc:      "unchanged",
+			files:     map[string]string{"BUILD.in": upstream, "BUILD.orig": upstream},
+			wantFiles: map[string]string{"BUILD.in": upstream, "BUILD.orig": upstream},
+		},
+		{
+			desc:      "unchanged_writes_orig",
+			files:     map[string]string{"BUILD.in": upstream},
+			wantFiles: map[string]string{"BUILD.in": upstream, "BUILD.orig": upstream},
+		},
+		{
+			desc:      "local_edits",
+			files:     map[string]string{"BUILD.in": local, "BUILD.orig": upstream},
+			wantFiles: map[string]string{"BUILD.in": local, "BUILD.orig": upstream},
+		},
+		{
+			desc:       "update",
+			files:      map[string]string{"BUILD.in": base, "BUILD.orig": base},
+			wantStatus: "update",
+			wantFiles:  map[string]string{"BUILD.in": upstream, "BUILD.orig": upstream},
+		},
+		{
+			desc:       "merge",
+			files:      map[string]string{"BUILD.in": local, "BUILD.orig": base},
+			wantStatus: "merge",
+			wantFiles:  map[string]string{"BUILD.in": merged, "BUILD.orig": upstream},
+		},
+		{
+			desc:       "merge_removes_stale_upstream",
+			files:      map[string]string{"BUILD.in": local, "BUILD.orig": base, "BUILD.upstream": "old\n"},
+			wantStatus: "merge",
+			wantFiles:  map[string]string{"BUILD.in": merged, "BUILD.orig": upstream},
+		},
+		{
+			desc:       "merge_conflict",
+			files:      map[string]string{"BUILD.in": conflict, "BUILD.orig": base},
+			wantStatus: "conflict",
+			wantFiles:  map[string]string{"BUILD.in": conflict, "BUILD.orig": base, "BUILD.upstream": upstream},
+		},
+		{
+			desc:       "no_orig_conflict",
+			files:      map[string]string{"BUILD.in": local},
+			wantStatus: "conflict",
+			wantFiles:  map[string]string{"BUILD.in": local, "BUILD.upstream": upstream},
+		},
+	} {
+		for _, dryRun := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/dryRun=%v", tt.desc, dryRun), func(t *testing.T) {
+				dir := t.TempDir()
+				from := filepath.Join(dir, "src", "BUILD")
+				toDir := filepath.Join(dir, "third_party", "rules_foo")
+				writeFiles(t, dir, map[string]string{"src/BUILD": upstream})
+				if err := os.MkdirAll(toDir, 0777); err != nil {
+					t.Fatal(err)
+				}
+				writeFiles(t, toDir, tt.files)
+
+				status, err := updateInFile(from, filepath.Join(toDir, "BUILD.in"), nil, dryRun)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if status != tt.wantStatus {
+					t.Errorf("got status %q; want %q", status, tt.wantStatus)
+				}
+				wantFiles := tt.wantFiles
+				if dryRun {
+					wantFiles = tt.files
+				}
+				gotFiles := make(map[string]string)
+				for _, name := range listFiles(t, toDir, "")[1:] {
+					data, err := ioutil.ReadFile(filepath.Join(toDir, name))
+					if err != nil {
+						t.Fatal(err)
+					}
+					gotFiles[name] = string(data)
+				}
+				if fmt.Sprint(gotFiles) != fmt.Sprint(wantFiles) {
+					t.Errorf("got files %q; want %q", gotFiles, wantFiles)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/buildtools/build"
+	"github.com/jayconrod/misc/internal/diff"
+)
+
+// manifest is the parsed content of third_party/manifest.bzl. The file
+// assigns a dict to manifest. Each key is the name of a repository, and
+// each value is a dict mapping labels of .in files in third_party to the
+// paths of the BUILD files they replace within the repository.
+//
+// The file may contain other statements, like loads or other dicts, and
+// comments. Only the text of the manifest dict is rewritten when the
+// manifest is written back, so everything else is preserved exactly.
+type manifest struct {
+	path string
+
+	// oldContent is the content of the file when it was read, or nil if it
+	// didn't exist.
+	oldContent []byte
+
+	file *build.File
+
+	// assign is the assignment to manifest, or nil if the file doesn't have
+	// one yet.
+	assign *build.AssignExpr
+
+	dict *build.DictExpr
+}
+
+// readManifest reads and parses third_party/manifest.bzl. If the file
+// doesn't exist or doesn't assign manifest, readManifest returns an empty
+// manifest that will be added when the file is written.
+func readManifest() (m *manifest, err error) {
+	path := filepath.Join("third_party", "manifest.bzl")
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("reading manifest: %w", err)
+		}
+	}()
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		content = nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parseManifest(path, content)
+}
+
+// parseManifest parses the content of a manifest file read from path.
+func parseManifest(path string, content []byte) (m *manifest, err error) {
+	m = &manifest{path: path, oldContent: content}
+	m.file, err = build.ParseBzl(m.path, content)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stmt := range m.file.Stmt {
+		assign, ok := stmt.(*build.AssignExpr)
+		if !ok || assign.Op != "=" {
+			continue
+		}
+		if id, ok := assign.LHS.(*build.Ident); !ok || id.Name != "manifest" {
+			continue
+		}
+		if m.assign != nil {
+			return nil, fmt.Errorf("%s: manifest is assigned more than once, at lines %d and %d", m.path, m.line(m.assign), m.line(assign))
+		}
+		m.assign = assign
+	}
+	if m.assign == nil {
+		m.dict = &build.DictExpr{ForceMultiLine: true}
+		return m, nil
+	}
+
+	var ok bool
+	m.dict, ok = m.assign.RHS.(*build.DictExpr)
+	if !ok {
+		return nil, fmt.Errorf("%s:%d: manifest must be assigned a dict literal", m.path, m.line(m.assign.RHS))
+	}
+	if err := m.checkDict(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// checkDict checks that the manifest dict has the structure the other
+// methods expect: string keys mapped to dicts with string keys, or to
+// other values that can't be updated.
+func (m *manifest) checkDict() error {
+	seen := make(map[string]bool)
+	for _, entry := range m.dict.List {
+		kv, ok := entry.(*build.KeyValueExpr)
+		if !ok {
+			return fmt.Errorf("%s:%d: manifest entry is not a key: value pair", m.path, m.line(entry))
+		}
+		key, ok := kv.Key.(*build.StringExpr)
+		if !ok {
+			return fmt.Errorf("%s:%d: manifest key is not a string literal", m.path, m.line(kv.Key))
+		}
+		if seen[key.Value] {
+			return fmt.Errorf("%s:%d: repository %s appears more than once", m.path, m.line(kv.Key), key.Value)
+		}
+		seen[key.Value] = true
+		// Values that aren't dict literals, like references to other dicts,
+		// are allowed until add-3p-repo needs to change them.
+		if repoDict, ok := kv.Value.(*build.DictExpr); ok {
+			for _, fileEntry := range repoDict.List {
+				fileKV, ok := fileEntry.(*build.KeyValueExpr)
+				if !ok {
+					return fmt.Errorf("%s:%d: entry for %s is not a key: value pair", m.path, m.line(fileEntry), key.Value)
+				}
+				if _, ok := fileKV.Key.(*build.StringExpr); !ok {
+					return fmt.Errorf("%s:%d: label in entry for %s is not a string literal", m.path, m.line(fileKV.Key), key.Value)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// line returns the line where x starts in the manifest file.
+func (m *manifest) line(x build.Expr) int {
+	start, _ := x.Span()
+	return start.Line
+}
+
+// repos returns the names of the repositories in the manifest.
+func (m *manifest) repos() []string {
+	var repos []string
+	for _, entry := range m.dict.List {
+		repos = append(repos, entryKey(entry))
+	}
+	return repos
+}
+
+// workspaceName returns the workspace name used in the manifest's labels,
+// or "" if there are no labels.
+func (m *manifest) workspaceName() string {
+	for _, entry := range m.dict.List {
+		repoDict, ok := entry.(*build.KeyValueExpr).Value.(*build.DictExpr)
+		if !ok {
+			continue
+		}
+		for _, fileEntry := range repoDict.List {
+			label := entryKey(fileEntry)
+			if !strings.HasPrefix(label, "@") {
+				continue
+			}
+			if i := strings.Index(label, "//"); i > 0 {
+				return label[1:i]
+			}
+		}
+	}
+	return ""
+}
+
+// setRepo adds or replaces the entry for repo. relPaths are the
+// slash-separated paths of BUILD files within the repository. Comments on
+// the repository's entry and on files that are still present are kept.
+func (m *manifest) setRepo(workspaceName, repo string, relPaths []string) error {
+	repoEntry, repoDict, err := m.repoEntry(repo)
+	if err != nil {
+		return err
+	}
+	if repoEntry == nil {
+		repoDict = &build.DictExpr{}
+		repoEntry = &build.KeyValueExpr{
+			Key:   &build.StringExpr{Value: repo},
+			Value: repoDict,
+		}
+		m.dict.List = append(m.dict.List, repoEntry)
+		sort.SliceStable(m.dict.List, func(i, j int) bool {
+			return entryKey(m.dict.List[i]) < entryKey(m.dict.List[j])
+		})
+	}
+
+	oldEntries := make(map[string]*build.KeyValueExpr)
+	for _, entry := range repoDict.List {
+		oldEntries[entryKey(entry)] = entry.(*build.KeyValueExpr)
+	}
+	entries := make([]build.Expr, 0, len(relPaths))
+	for _, value := range relPaths {
+		key := fmt.Sprintf("@%s//third_party:%s/%s.in", workspaceName, repo, value)
+		entry, ok := oldEntries[key]
+		if !ok {
+			entry = &build.KeyValueExpr{Key: &build.StringExpr{Value: key}}
+		}
+		if s, ok := entry.Value.(*build.StringExpr); !ok || s.Value != value {
+			entry.Value = &build.StringExpr{Value: value}
+		}
+		entries = append(entries, entry)
+	}
+	repoDict.List = entries
+	repoDict.ForceMultiLine = true
+	m.dict.ForceMultiLine = true
+	return nil
+}
+
+// removeRepo removes the entry for repo. It reports whether there was one.
+func (m *manifest) removeRepo(repo string) bool {
+	i := m.repoIndex(repo)
+	if i < 0 {
+		return false
+	}
+	m.dict.List = append(m.dict.List[:i], m.dict.List[i+1:]...)
+	return true
+}
+
+// repoEntry returns the entry for repo and its dict of files, or nils if
+// there's no entry. It returns an error if the entry's value isn't a dict
+// literal, since setRepo can't update it.
+func (m *manifest) repoEntry(repo string) (*build.KeyValueExpr, *build.DictExpr, error) {
+	i := m.repoIndex(repo)
+	if i < 0 {
+		return nil, nil, nil
+	}
+	entry := m.dict.List[i].(*build.KeyValueExpr)
+	repoDict, ok := entry.Value.(*build.DictExpr)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s:%d: entry for %s is not a dict literal and can't be updated", m.path, m.line(entry.Value), repo)
+	}
+	return entry, repoDict, nil
+}
+
+func (m *manifest) repoIndex(repo string) int {
+	for i, entry := range m.dict.List {
+		if entryKey(entry) == repo {
+			return i
+		}
+	}
+	return -1
+}
+
+// entryKey returns the key of a dict entry checked by readManifest.
+func entryKey(entry build.Expr) string {
+	return entry.(*build.KeyValueExpr).Key.(*build.StringExpr).Value
+}
+
+// write formats the manifest dict and writes it back, replacing only the
+// text of the dict in the original file. If the file didn't assign
+// manifest, the assignment is appended. If dryRun is set, a diff of the
+// change is printed instead.
+func (m *manifest) write(dryRun bool) error {
+	dictText := build.FormatString(m.dict)
+	var content []byte
+	if m.assign != nil {
+		start, end := m.dict.Span()
+		content = append(content, m.oldContent[:start.Byte]...)
+		content = append(content, dictText...)
+		content = append(content, m.oldContent[end.Byte:]...)
+	} else {
+		content = append(content, m.oldContent...)
+		if len(content) > 0 {
+			if !bytes.HasSuffix(content, []byte("\n")) {
+				content = append(content, '\n')
+			}
+			content = append(content, '\n')
+		}
+		content = append(content, "manifest = "+dictText+"\n"...)
+	}
+
+	if dryRun {
+		name := filepath.ToSlash(m.path)
+		os.Stdout.Write(diff.Unified("a/"+name, "b/"+name, m.oldContent, content))
+		return nil
+	}
+	return ioutil.WriteFile(m.path, content, 0666)
+}
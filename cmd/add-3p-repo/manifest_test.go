@@ -0,0 +1,197 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/buildtools/build"
+)
+
+func TestManifestEdit(t *testing.T) {
+	const old = `# Overlays for third-party repositories.
+load("//tools:defs.bzl", "helper")
+
+extra = {
+    "unrelated":   "dict",  # stays misformatted
+}
+
+manifest = {
+    # Keep rules_foo pinned.
+    "rules_foo": {
+        # Hand-written.
+        "@ws//third_party:rules_foo/BUILD.bazel.in": "BUILD.bazel",
+        "@ws//third_party:rules_foo/old/BUILD.in": "old/BUILD",
+    },
+    "rules_zzz": extra,
+}
+
+# Trailing comment.
+helper(manifest)
+`
+	const want = `# Overlays for third-party repositories.
+load("//tools:defs.bzl", "helper")
+
+extra = {
+    "unrelated":   "dict",  # stays misformatted
+}
+
+manifest = {
+    "rules_bar": {
+        "@ws//third_party:rules_bar/BUILD.bazel.in": "BUILD.bazel",
+    },
+    # Keep rules_foo pinned.
+    "rules_foo": {
+        # Hand-written.
+        "@ws//third_party:rules_foo/BUILD.bazel.in": "BUILD.bazel",
+        "@ws//third_party:rules_foo/new/BUILD.bazel.in": "new/BUILD.bazel",
+    },
+    "rules_zzz": extra,
+}
+
+# Trailing comment.
+helper(manifest)
+`
+	path := filepath.Join(t.TempDir(), "manifest.bzl")
+	m, err := parseManifest(path, []byte(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(m.repos(), ","), "rules_foo,rules_zzz"; got != want {
+		t.Errorf("repos: got %s; want %s", got, want)
+	}
+	if got, want := m.workspaceName(), "ws"; got != want {
+		t.Errorf("workspaceName: got %s; want %s", got, want)
+	}
+	if err := m.setRepo("ws", "rules_foo", []string{"BUILD.bazel", "new/BUILD.bazel"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.setRepo("ws", "rules_bar", []string{"BUILD.bazel"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.setRepo("ws", "rules_zzz", nil); err == nil || !strings.Contains(err.Error(), ":15: entry for rules_zzz is not a dict literal") {
+		t.Errorf("setRepo of non-dict entry: got error %v", err)
+	}
+	if err := m.write(false); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Written manifests can be read back and removed from.
+	m, err = parseManifest(path, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.removeRepo("rules_bar") || m.removeRepo("rules_bar") {
+		t.Errorf("removeRepo did not remove rules_bar exactly once")
+	}
+	if err := m.write(false); err != nil {
+		t.Fatal(err)
+	}
+	got, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Replace(want, `    "rules_bar": {
+        "@ws//third_party:rules_bar/BUILD.bazel.in": "BUILD.bazel",
+    },
+`, "", 1); string(got) != want {
+		t.Errorf("after removeRepo, got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestManifestAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manifest.bzl")
+	m, err := parseManifest(path, []byte(`load(":x.bzl", "x")`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.setRepo("ws", "rules_foo", []string{"BUILD"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.write(false); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `load(":x.bzl", "x")
+
+manifest = {
+    "rules_foo": {
+        "@ws//third_party:rules_foo/BUILD.in": "BUILD",
+    },
+}
+`
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestManifestErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc, content, wantErr string
+	}{
+		{
+			desc:    "not_dict",
+			content: "x = 1\nmanifest = [\"rules_foo\"]\n",
+			wantErr: "manifest.bzl:2: manifest must be assigned a dict literal",
+		},
+		{
+			desc:    "assigned_twice",
+			content: "manifest = {}\nmanifest = {}\n",
+			wantErr: "manifest.bzl: manifest is assigned more than once, at lines 1 and 2",
+		},
+		{
+			desc:    "duplicate_repo",
+			content: "manifest = {\n    \"a\": {},\n    \"a\": {},\n}\n",
+			wantErr: "manifest.bzl:3: repository a appears more than once",
+		},
+		{
+			desc:    "key_not_string",
+			content: "manifest = {\n    A: {},\n}\n",
+			wantErr: "manifest.bzl:2: manifest key is not a string literal",
+		},
+		{
+			desc:    "label_not_string",
+			content: "manifest = {\n    \"a\": {\n        LABEL: \"BUILD\",\n    },\n}\n",
+			wantErr: "manifest.bzl:3: label in entry for a is not a string literal",
+		},
+		{
+			desc:    "syntax",
+			content: "manifest = {\n",
+			wantErr: "syntax error",
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			_, err := parseManifest("manifest.bzl", []byte(tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v; want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// The parser never produces dict entries that aren't key: value pairs,
+	// but checkDict reports them rather than letting other methods panic.
+	m, err := parseManifest("manifest.bzl", []byte("manifest = {\n    \"a\": {},\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.dict.List = append(m.dict.List, &build.StringExpr{Value: "b"})
+	if err := m.checkDict(); err == nil || !strings.Contains(err.Error(), "manifest entry is not a key: value pair") {
+		t.Errorf("checkDict with non-key-value entry: got error %v", err)
+	}
+	m.dict.List[0].(*build.KeyValueExpr).Value.(*build.DictExpr).List = []build.Expr{&build.StringExpr{Value: "c"}}
+	m.dict.List = m.dict.List[:1]
+	if err := m.checkDict(); err == nil || !strings.Contains(err.Error(), "entry for a is not a key: value pair") {
+		t.Errorf("checkDict with non-key-value file entry: got error %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// overlayHeader marks overlay.bzl as generated. If a user removes it,
+// add-3p-repo stops updating the file.
+const overlayHeader = "# Code generated by add-3p-repo. DO NOT EDIT.\n"
+
+// overlayBzl is the content of third_party/overlay.bzl. It defines a
+// repository rule that downloads an archive and replaces BUILD files with
+// the .in files listed in manifest.bzl.
+const overlayBzl = overlayHeader + `
+"""Repository rules that overlay BUILD files in third_party onto external
+repositories, according to manifest.bzl.
+
+In WORKSPACE:
+
+    load("//third_party:overlay.bzl", "third_party_repository")
+
+    third_party_repository(
+        name = "rules_foo",
+        urls = ["https://example.com/rules_foo-1.0.tar.gz"],
+        sha256 = "...",
+        strip_prefix = "rules_foo-1.0",
+    )
+"""
+
+load(":manifest.bzl", "manifest")
+
+def _overlay_repository_impl(ctx):
+    ctx.download_and_extract(
+        url = ctx.attr.urls,
+        sha256 = ctx.attr.sha256,
+        stripPrefix = ctx.attr.strip_prefix,
+    )
+    for label, path in ctx.attr.overlay.items():
+        ctx.delete(path)
+        ctx.symlink(ctx.path(label), path)
+
+overlay_repository = repository_rule(
+    implementation = _overlay_repository_impl,
+    attrs = {
+        "urls": attr.string_list(
+            mandatory = True,
+            doc = "URLs of an archive containing the repository.",
+        ),
+        "sha256": attr.string(
+            doc = "Expected SHA-256 of the archive.",
+        ),
+        "strip_prefix": attr.string(
+            doc = "Directory prefix to strip from files in the archive.",
+        ),
+        "overlay": attr.label_keyed_string_dict(
+            allow_files = True,
+            doc = "Files to link into the repository, mapped to their paths within it.",
+        ),
+    },
+    doc = "Downloads a repository and replaces its BUILD files.",
+)
+
+def third_party_repository(name, **kwargs):
+    """Declares an overlay_repository using the files listed for name in
+    manifest.bzl."""
+    overlay_repository(
+        name = name,
+        overlay = manifest.get(name, {}),
+        **kwargs
+    )
+`
+
+// thirdPartyBuild is the content of third_party/BUILD.bazel. The package
+// must exist for labels of .in files in manifest.bzl to resolve.
+const thirdPartyBuild = `# .in files in this package are overlaid onto external repositories by
+# overlay.bzl, according to manifest.bzl. See add-3p-repo.
+`
+
+// writeOverlayFiles creates or updates third_party/overlay.bzl and creates
+// third_party/BUILD.bazel if there's no BUILD file in third_party. An
+// overlay.bzl file without overlayHeader is left alone. If dryRun is set,
+// the files that would be written are printed instead.
+func writeOverlayFiles(dryRun bool) error {
+	overlayPath := filepath.Join("third_party", "overlay.bzl")
+	content, err := ioutil.ReadFile(overlayPath)
+	if os.IsNotExist(err) || (err == nil && bytes.HasPrefix(content, []byte(overlayHeader)) && string(content) != overlayBzl) {
+		if err := writeThirdPartyFile(overlayPath, overlayBzl, dryRun); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	for _, name := range []string{"BUILD.bazel", "BUILD"} {
+		if _, err := os.Stat(filepath.Join("third_party", name)); err == nil {
+			return nil
+		}
+	}
+	return writeThirdPartyFile(filepath.Join("third_party", "BUILD.bazel"), thirdPartyBuild, dryRun)
+}
+
+func writeThirdPartyFile(path, content string, dryRun bool) error {
+	if dryRun {
+		fmt.Printf("write %s\n", path)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(content), 0666)
+}
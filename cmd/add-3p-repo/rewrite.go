@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/buildtools/build"
+)
+
+// A rewriteRule replaces a label prefix in BUILD files copied into
+// third_party. Upstream BUILD files often refer to their own repository by
+// a name that's different in this workspace, or to load paths and
+// visibility packages that don't exist here.
+type rewriteRule struct {
+	old, new string
+}
+
+// rewriteRules is a flag.Value that accumulates rules from a repeated
+// -rewrite old=new flag. The first matching rule applies.
+type rewriteRules []rewriteRule
+
+func (rules *rewriteRules) String() string {
+	var b strings.Builder
+	for i, r := range *rules {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(r.old + "=" + r.new)
+	}
+	return b.String()
+}
+
+func (rules *rewriteRules) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return fmt.Errorf("rewrite rule %q: want old=new", s)
+	}
+	r := rewriteRule{old: s[:i], new: s[i+1:]}
+	if !isAbsLabel(r.old) {
+		return fmt.Errorf("rewrite rule %q: %q must start with @ or //", s, r.old)
+	}
+	if r.new == "" {
+		return fmt.Errorf("rewrite rule %q: replacement is empty", s)
+	}
+	*rules = append(*rules, r)
+	return nil
+}
+
+// rewriteRulesHeader starts each rewrites.txt file.
+const rewriteRulesHeader = "# Label rewrite rules for BUILD files copied by add-3p-repo, one old=new\n# per line. The first matching rule applies.\n"
+
+// rewriteRulesPath returns the path of the file where the rewrite rules
+// for repo are saved, so sync and later adds apply the same rules.
+func rewriteRulesPath(repo string) string {
+	return filepath.Join("third_party", repo, "rewrites.txt")
+}
+
+// readRewriteRules returns the rewrite rules saved for repo, or no rules if
+// none were saved.
+func readRewriteRules(repo string) (rewriteRules, error) {
+	path := rewriteRulesPath(repo)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var rules rewriteRules
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := rules.Set(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+	}
+	return rules, nil
+}
+
+// writeRewriteRules saves the rewrite rules for repo. If there are no rules,
+// the file is removed. If dryRun is set, the file that would be written or
+// removed is printed instead.
+func writeRewriteRules(repo string, rules rewriteRules, dryRun bool) error {
+	path := rewriteRulesPath(repo)
+	if len(rules) == 0 {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil
+		}
+		if dryRun {
+			fmt.Printf("delete %s\n", path)
+			return nil
+		}
+		return os.Remove(path)
+	}
+
+	var b strings.Builder
+	b.WriteString(rewriteRulesHeader)
+	for _, r := range rules {
+		b.WriteString(r.old + "=" + r.new + "\n")
+	}
+	if old, err := ioutil.ReadFile(path); err == nil && string(old) == b.String() {
+		return nil
+	}
+	return writeThirdPartyFile(path, b.String(), dryRun)
+}
+
+// rewriteLabel applies the first rule whose prefix matches label. A prefix
+// only matches at a package or target boundary, so "@foo" doesn't match
+// "@foobar//:x". It reports whether any rule matched.
+func (rules rewriteRules) rewriteLabel(label string) (string, bool) {
+	if label == "//visibility:public" || label == "//visibility:private" {
+		return label, false
+	}
+	for _, r := range rules {
+		if !strings.HasPrefix(label, r.old) {
+			continue
+		}
+		rest := label[len(r.old):]
+		if rest != "" && !strings.HasSuffix(r.old, "/") && !strings.HasSuffix(r.old, ":") && rest[0] != '/' && rest[0] != ':' {
+			continue
+		}
+		return r.new + rest, true
+	}
+	return label, false
+}
+
+// labelAttrs are the names of rule attributes that hold labels. Attributes
+// whose names end with "deps", "srcs", or "hdrs" hold labels, too.
+var labelAttrs = map[string]bool{
+	"actual":                 true,
+	"compatible_with":        true,
+	"data":                   true,
+	"default_visibility":     true,
+	"embed":                  true,
+	"exec_compatible_with":   true,
+	"exports":                true,
+	"library":                true,
+	"main":                   true,
+	"plugins":                true,
+	"resources":              true,
+	"restricted_to":          true,
+	"src":                    true,
+	"target_compatible_with": true,
+	"toolchains":             true,
+	"tools":                  true,
+	"visibility":             true,
+}
+
+func isLabelAttr(name string) bool {
+	return labelAttrs[name] || strings.HasSuffix(name, "deps") || strings.HasSuffix(name, "srcs") || strings.HasSuffix(name, "hdrs")
+}
+
+// isLabelString reports whether a string literal, with the given stack of
+// enclosing expressions from build.Walk, holds a label: it's the path in
+// a load statement, or it's within the value of a label attribute, such as
+// an element of a deps list or a key or value of a select in deps.
+func isLabelString(s *build.StringExpr, stk []build.Expr) bool {
+	if len(stk) > 0 {
+		if load, ok := stk[len(stk)-1].(*build.LoadStmt); ok {
+			return load.Module == s
+		}
+	}
+	// Find the innermost keyword argument containing s.
+	for i := len(stk) - 1; i > 0; i-- {
+		kwarg, ok := stk[i].(*build.AssignExpr)
+		if !ok {
+			continue
+		}
+		if _, ok := stk[i-1].(*build.CallExpr); !ok {
+			continue
+		}
+		id, ok := kwarg.LHS.(*build.Ident)
+		return ok && isLabelAttr(id.Name)
+	}
+	return false
+}
+
+// rewrite applies rules to labels in the BUILD file content read from
+// name. Labels are string literals starting with @ or // in load paths and
+// label attributes (see isLabelString); strings elsewhere, like doc
+// attributes or variables, are left alone. Only the rewritten string
+// literals are changed, keeping their quotes; the rest of the file keeps
+// its formatting.
+func (rules rewriteRules) rewrite(name string, content []byte) ([]byte, error) {
+	if len(rules) == 0 {
+		return content, nil
+	}
+	f, err := build.ParseBuild(name, content)
+	if err != nil {
+		return nil, err
+	}
+
+	type edit struct {
+		start, end int
+		text       string
+	}
+	var edits []edit
+	build.Walk(f, func(x build.Expr, stk []build.Expr) {
+		s, ok := x.(*build.StringExpr)
+		if !ok || !isAbsLabel(s.Value) || !isLabelString(s, stk) {
+			return
+		}
+		if label, ok := rules.rewriteLabel(s.Value); ok && label != s.Value {
+			start, end := s.Span()
+			edits = append(edits, edit{start.Byte, end.Byte, quoteLike(content[start.Byte:end.Byte], s.TripleQuote, label)})
+		}
+	})
+
+	// Apply edits from the end of the file so earlier offsets stay valid.
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	out := append([]byte(nil), content...)
+	for _, e := range edits {
+		out = append(out[:e.start], append([]byte(e.text), out[e.end:]...)...)
+	}
+	return out, nil
+}
+
+// quoteLike returns a string literal for value, quoted the same way as the
+// literal raw, so rewriting a label doesn't change its quotes. If value
+// can't be written with raw's quotes, it's quoted in the default style.
+func quoteLike(raw []byte, tripleQuote bool, value string) string {
+	i := bytes.IndexAny(raw, `"'`)
+	n := 1
+	if tripleQuote {
+		n = 3
+	}
+	if i < 0 || len(raw) < i+2*n || strings.ContainsAny(value, "\\\"'\n") {
+		return build.FormatString(&build.StringExpr{Value: value})
+	}
+	return string(raw[:i+n]) + value + string(raw[len(raw)-n:])
+}
+
+func isAbsLabel(s string) bool {
+	return strings.HasPrefix(s, "@") || strings.HasPrefix(s, "//")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRewriteLabel(t *testing.T) {
+	rules := rewriteRules{
+		{old: "@foo", new: "@ws//third_party/foo"},
+		{old: "//tools/", new: "//third_party/foo/tools/"},
+		{old: "//bar:", new: "//baz:"},
+		{old: "//", new: "@ws//third_party/foo/"},
+	}
+	for _, tt := range []struct {
+		label, want string
+		wantOK      bool
+	}{
+		{label: "@foo//a:b", want: "@ws//third_party/foo//a:b", wantOK: true},
+		{label: "@foo", want: "@ws//third_party/foo", wantOK: true},
+		{label: "@foobar//a:b", want: "@foobar//a:b"},
+		{label: "//tools/x:y", want: "//third_party/foo/tools/x:y", wantOK: true},
+		{label: "//bar:x", want: "//baz:x", wantOK: true},
+		{label: "//a:b", want: "@ws//third_party/foo/a:b", wantOK: true},
+		{label: "//visibility:public", want: "//visibility:public"},
+		{label: "//visibility:private", want: "//visibility:private"},
+	} {
+		got, ok := rules.rewriteLabel(tt.label)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("rewriteLabel(%q): got %q, %v; want %q, %v", tt.label, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	rules := rewriteRules{{old: "@foo", new: "@ws//third_party/foo"}}
+	const content = `load("@foo//:defs.bzl", "foo_library")
+load('@foo//:other.bzl', "@foo//:not_a_label")
+
+DEPS = ["@foo//:kept_variable"]
+
+foo_library(
+    name = "@foo//:name",
+    srcs = ['@foo//:a.go'],
+    doc = """@foo//:doc""",
+    deps = select({
+        "@foo//:cond": ["@foo//:dep"],
+        "//conditions:default": DEPS,
+    }) + ["@foobar//:dep"],
+    visibility = ["//visibility:public"],
+    runtime_deps = [r"@foo//:raw"],
+)
+`
+	const want = `load("@ws//third_party/foo//:defs.bzl", "foo_library")
+load('@ws//third_party/foo//:other.bzl', "@foo//:not_a_label")
+
+DEPS = ["@foo//:kept_variable"]
+
+foo_library(
+    name = "@foo//:name",
+    srcs = ['@ws//third_party/foo//:a.go'],
+    doc = """@foo//:doc""",
+    deps = select({
+        "@ws//third_party/foo//:cond": ["@ws//third_party/foo//:dep"],
+        "//conditions:default": DEPS,
+    }) + ["@foobar//:dep"],
+    visibility = ["//visibility:public"],
+    runtime_deps = [r"@ws//third_party/foo//:raw"],
+)
+`
+	got, err := rules.rewrite("BUILD", []byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if got, err := (rewriteRules)(nil).rewrite("BUILD", []byte("syntax error (")); err != nil || string(got) != "syntax error (" {
+		t.Errorf("with no rules: got %q, %v; want content unchanged", got, err)
+	}
+	if _, err := rules.rewrite("BUILD", []byte("syntax error (")); err == nil {
+		t.Errorf("with syntax error: got no error")
+	}
+}
+
+func TestRewriteRulesFile(t *testing.T) {
+	chdirTemp(t)
+	rules := rewriteRules{
+		{old: "@foo", new: "@ws//third_party/foo"},
+		{old: "//", new: "@ws//third_party/foo/"},
+	}
+
+	// A dry run only prints what would be written.
+	if err := writeRewriteRules("rules_foo", rules, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(rewriteRulesPath("rules_foo")); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote rules file")
+	}
+
+	if err := writeRewriteRules("rules_foo", rules, false); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(rewriteRulesPath("rules_foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := rewriteRulesHeader + "@foo=@ws//third_party/foo\n//=@ws//third_party/foo/\n"; string(data) != want {
+		t.Errorf("got rules file:\n%s\nwant:\n%s", data, want)
+	}
+	got, err := readRewriteRules("rules_foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != rules.String() {
+		t.Errorf("read rules %s; want %s", got.String(), rules.String())
+	}
+
+	// Writing no rules removes the file, and reading a missing file returns
+	// no rules.
+	if err := writeRewriteRules("rules_foo", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(rewriteRulesPath("rules_foo")); !os.IsNotExist(err) {
+		t.Errorf("rules file not removed")
+	}
+	if got, err := readRewriteRules("rules_foo"); err != nil || len(got) != 0 {
+		t.Errorf("reading missing rules file: got %v, %v; want no rules", got, err)
+	}
+
+	writeFiles(t, ".", map[string]string{rewriteRulesPath("rules_bad"): "# comment\n\nfoo=bar\n"})
+	_, err = readRewriteRules("rules_bad")
+	if want := `rewrites.txt:3: rewrite rule "foo=bar": "foo" must start with @ or //`; err == nil || !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("reading bad rule: got error %v; want error ending with %q", err, want)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/bazelbuild/buildtools/build"
+)
+
+// rootFileNames are the names of files that mark the root of a Bazel
+// workspace.
+var rootFileNames = []string{"MODULE.bazel", "WORKSPACE.bazel", "WORKSPACE"}
+
+// cdToRoot changes to the root directory of the workspace. If root is
+// empty, cdToRoot looks for the innermost directory containing the current
+// directory with one of rootFileNames, so a nested workspace is used
+// instead of the workspace containing it.
+func cdToRoot(root string) error {
+	if root != "" {
+		if !hasRootFile(root) {
+			return fmt.Errorf("-workspace_root %s: no MODULE.bazel, WORKSPACE.bazel, or WORKSPACE file", root)
+		}
+		return os.Chdir(root)
+	}
+
+	dir, err := filepath.Abs(".")
+	if err != nil {
+		return err
+	}
+	for !hasRootFile(dir) {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return fmt.Errorf("could not locate MODULE.bazel, WORKSPACE.bazel, or WORKSPACE in any parent directory")
+		}
+		dir = parent
+	}
+	return os.Chdir(dir)
+}
+
+func hasRootFile(dir string) bool {
+	for _, name := range rootFileNames {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// workspaceNameFromRoot returns the name of the workspace in the current
+// directory: the name passed to module() in MODULE.bazel, or if that's not
+// set, the name passed to workspace() in WORKSPACE.bazel or WORKSPACE.
+func workspaceNameFromRoot() (string, error) {
+	for _, name := range rootFileNames {
+		content, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		var f *build.File
+		var kind string
+		if name == "MODULE.bazel" {
+			f, err = build.ParseDefault(name, content)
+			kind = "module"
+		} else {
+			f, err = build.ParseWorkspace(name, content)
+			kind = "workspace"
+		}
+		if err != nil {
+			return "", err
+		}
+		for _, r := range f.Rules(kind) {
+			if wsName := r.AttrString("name"); wsName != "" {
+				return wsName, nil
+			}
+		}
+		if name == "WORKSPACE.bazel" {
+			// Bazel ignores WORKSPACE when WORKSPACE.bazel is present.
+			break
+		}
+	}
+	return "", fmt.Errorf("-workspace_name was not set, and no name was found in module() in MODULE.bazel or workspace() in WORKSPACE")
+}
@@ -1,15 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 
+	"github.com/jayconrod/misc/internal/diff"
+	"github.com/jayconrod/misc/txtarproxy"
 	"golang.org/x/tools/txtar"
 )
 
@@ -20,83 +29,650 @@ func main() {
 	}
 }
 
-func run(args []string) error {
+func run(args []string) (err error) {
 	fs := flag.NewFlagSet("fixtestsum", flag.ExitOnError)
-	var modName string
-	fs.StringVar(&modName, "modname", "go.mod", "name of go.mod file")
+	cfg := &config{}
+	var goProxy, goFlags, fixturesDir string
+	var hermetic bool
+	var jobs int
+	var extraEnv stringList
+	fs.StringVar(&cfg.modName, "modname", "", "name of a single go.mod file to fix; by default, every go.mod and go.work file in the archive is fixed")
+	fs.StringVar(&cfg.goCmd, "go", "go", "path to the go command")
+	fs.StringVar(&goProxy, "goproxy", "", "GOPROXY for the go command (default https://proxy.golang.org,direct, or only the -fixtures proxy if set)")
+	fs.StringVar(&goFlags, "goflags", "", "GOFLAGS for the go command")
+	fs.Var(&extraEnv, "env", "extra KEY=VALUE environment variable for the go command (may be repeated)")
+	fs.BoolVar(&hermetic, "hermetic", true, "run the go command with a clean environment and a temporary GOPATH and module cache, ignoring GO* variables and go env settings")
+	fs.StringVar(&fixturesDir, "fixtures", "", "directory of txtar module archives to serve with an in-process proxy, for fixing sums offline")
+	fs.BoolVar(&cfg.check, "check", false, "report archives with stale sum files and exit with an error instead of rewriting them")
+	fs.BoolVar(&cfg.diff, "diff", false, "like -check, but also print a unified diff of the changes each archive needs")
+	fs.BoolVar(&cfg.script, "script", true, "interpret cd, env, cp, mkdir, rm, and 'go mod edit' commands in the archive comment before the first other go command, as in cmd/go script tests")
+	fs.BoolVar(&cfg.merge, "merge", true, "update sum files by adding and removing individual lines, keeping lines named by '"+keepDirective+" module [version]' in the archive comment; if false, sum files are replaced with the go command's output")
+	fs.BoolVar(&cfg.tidy, "tidy", false, "run 'go mod tidy' in each module root and write back go.mod as well as go.sum")
+	fs.BoolVar(&cfg.vendor, "vendor", false, "run 'go mod vendor' (or 'go work vendor') in each root and write back vendor/modules.txt and vendored files")
+	fs.IntVar(&jobs, "j", runtime.NumCPU(), "number of archives to fix in parallel")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
+	if jobs < 1 {
+		return fmt.Errorf("-j must be at least 1")
+	}
+	if cfg.diff {
+		cfg.check = true
+	}
 
-	for _, arg := range args {
-		if err := fixTest(arg, modName); err != nil {
+	var env []string
+	if hermetic {
+		gopath, err := ioutil.TempDir("", "fixtestsum-gopath")
+		if err != nil {
 			return err
 		}
+		defer func() {
+			if rerr := os.RemoveAll(gopath); err == nil {
+				err = rerr
+			}
+		}()
+		for _, kv := range os.Environ() {
+			if !strings.HasPrefix(kv, "GO") {
+				env = append(env, kv)
+			}
+		}
+		env = append(env,
+			"GOENV=off",
+			"GOPATH="+gopath,
+			"GOMODCACHE="+filepath.Join(gopath, "pkg", "mod"),
+			"GOTOOLCHAIN=local",
+			// The module cache is read-only by default; -modcacherw lets us
+			// delete it when we're done.
+			"GOFLAGS="+strings.TrimSpace("-modcacherw "+goFlags),
+		)
+	} else {
+		env = os.Environ()
+		if goFlags != "" {
+			env = append(env, "GOFLAGS="+goFlags)
+		}
+	}
+
+	if fixturesDir != "" {
+		proxyURL, stop, err := startFixtureProxy(fixturesDir)
+		if err != nil {
+			return err
+		}
+		defer stop()
+		if goProxy == "" {
+			goProxy = proxyURL
+		} else {
+			goProxy = proxyURL + "," + goProxy
+		}
+		// Fixture modules aren't in the checksum database.
+		env = append(env, "GOSUMDB=off")
+	}
+	if goProxy != "" {
+		env = append(env, "GOPROXY="+goProxy)
+	} else if hermetic {
+		env = append(env, "GOPROXY=https://proxy.golang.org,direct")
+	}
+	for _, kv := range extraEnv {
+		if !strings.Contains(kv, "=") {
+			return fmt.Errorf("-env %q: want KEY=VALUE", kv)
+		}
+		env = append(env, kv)
+	}
+	cfg.env = env
+
+	return fixTests(fs.Args(), cfg, jobs)
+}
+
+// fixTests fixes each archive in testPaths, running up to jobs archives at
+// once. All archives share the go command's module cache. Progress is
+// printed to stderr as each archive finishes. An error in one archive
+// doesn't stop the others; failures (and in check mode, stale archives) are
+// summarized in the returned error.
+func fixTests(testPaths []string, cfg *config, jobs int) error {
+	type result struct {
+		testPath string
+		changed  bool
+		report   []byte
+		warnings []string
+		err      error
+	}
+	pathc := make(chan string)
+	resultc := make(chan result)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for testPath := range pathc {
+				changed, report, warnings, err := fixTest(testPath, cfg)
+				resultc <- result{testPath, changed, report, warnings, err}
+			}
+		}()
+	}
+	go func() {
+		for _, testPath := range testPaths {
+			pathc <- testPath
+		}
+		close(pathc)
+		wg.Wait()
+		close(resultc)
+	}()
+
+	var failed []error
+	var stale []string
+	done := 0
+	for r := range resultc {
+		done++
+		var status string
+		switch {
+		case r.err != nil:
+			status = "FAIL"
+			failed = append(failed, r.err)
+		case r.changed && cfg.check:
+			status = "stale"
+			stale = append(stale, r.testPath)
+		case r.changed:
+			status = "fixed"
+		default:
+			status = "ok"
+		}
+		fmt.Fprintf(os.Stderr, "[%d/%d] %s: %s\n", done, len(testPaths), r.testPath, status)
+		for _, w := range r.warnings {
+			fmt.Fprintf(os.Stderr, "\twarning: %s\n", strings.ReplaceAll(w, "\n", "\n\t\t"))
+		}
+		os.Stdout.Write(r.report)
 	}
+
+	if len(failed) == 0 && len(stale) == 0 {
+		return nil
+	}
+	sort.Strings(stale)
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Error() < failed[j].Error() })
+	buf := &strings.Builder{}
+	if len(stale) > 0 {
+		fmt.Fprintf(buf, "sum files are stale in %d of %d archive(s):\n", len(stale), len(testPaths))
+		for _, testPath := range stale {
+			fmt.Fprintf(buf, "\t%s\n", testPath)
+		}
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(buf, "%d of %d archive(s) failed:\n", len(failed), len(testPaths))
+		for _, err := range failed {
+			fmt.Fprintf(buf, "\t%s\n", strings.ReplaceAll(err.Error(), "\n", "\n\t\t"))
+		}
+	}
+	return errors.New(strings.TrimSuffix(buf.String(), "\n"))
+}
+
+// config holds settings that apply to every archive being fixed.
+type config struct {
+	// modName is the name of a single go.mod file to fix. If empty, every
+	// go.mod and go.work file is fixed.
+	modName string
+
+	// goCmd is the path to the go command.
+	goCmd string
+
+	// env is the environment the go command runs with.
+	env []string
+
+	// check indicates archives should be compared with their fixed
+	// versions but not written. If diff is also set, differences are
+	// printed to stdout.
+	check, diff bool
+
+	// script indicates the archive comment should be interpreted as a
+	// script test. See runScriptPrelude.
+	script bool
+
+	// merge indicates sum files should be updated with minimal changes.
+	// See mergeSum.
+	merge bool
+
+	// tidy and vendor indicate go.mod files should be tidied and vendor
+	// directories regenerated, in addition to fixing sum files.
+	tidy, vendor bool
+}
+
+// startFixtureProxy serves module archives in dir on a local port using
+// txtarproxy. It returns the proxy's URL and a function that stops it.
+func startFixtureProxy(dir string) (proxyURL string, stop func(), err error) {
+	s, err := txtarproxy.NewServer(os.DirFS(dir))
+	if err != nil {
+		return "", nil, err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	srv := &http.Server{Handler: s}
+	go srv.Serve(ln)
+	return "http://" + ln.Addr().String(), func() { srv.Close() }, nil
+}
+
+// stringList is a flag.Value that accumulates strings from a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
 	return nil
 }
 
-func fixTest(testPath, modName string) (err error) {
+// fixTest fixes the sum files in the archive at testPath and reports whether
+// anything changed. Normally, the archive is rewritten if anything changed.
+// In check mode, the archive is left alone. fixTest also returns a report of
+// what changed: a unified diff of the archive if cfg.diff is set, or a list
+// of changed lines and files otherwise, and warnings about roots that
+// couldn't be fixed.
+func fixTest(testPath string, cfg *config) (changed bool, report []byte, warnings []string, err error) {
 	defer func() {
 		if err != nil {
 			err = fmt.Errorf("fixing test %s: %w", testPath, err)
 		}
 	}()
 
-	dir, err := ioutil.TempDir("", "")
+	arc, err := txtar.ParseFile(testPath)
 	if err != nil {
-		return err
+		return false, nil, nil, err
+	}
+	// Compare formatted archives rather than the original file so that
+	// insignificant differences like a missing final newline don't count.
+	before := txtar.Format(arc)
+	changes, warnings, err := fixArchive(arc, cfg)
+	if err != nil {
+		return false, nil, nil, err
 	}
-	defer os.RemoveAll(dir)
+	after := txtar.Format(arc)
+	if bytes.Equal(before, after) {
+		return false, nil, warnings, nil
+	}
+	if cfg.diff {
+		report = diff.Unified("a/"+filepath.ToSlash(testPath), "b/"+filepath.ToSlash(testPath), before, after)
+	} else {
+		buf := &bytes.Buffer{}
+		for _, c := range changes {
+			fmt.Fprintf(buf, "%s: %s\n", testPath, c)
+		}
+		report = buf.Bytes()
+	}
+	if !cfg.check {
+		if err := ioutil.WriteFile(testPath, after, 0666); err != nil {
+			return false, nil, nil, err
+		}
+	}
+	return true, report, warnings, nil
+}
 
-	arc, err := txtar.ParseFile(testPath)
+// A root is a directory containing a go.mod or go.work file. Checksums for
+// a module root are stored in go.sum; checksums for a workspace root are
+// stored in go.work.sum.
+type root struct {
+	// modName is the slash-separated name of the go.mod or go.work file
+	// within the archive.
+	modName string
+}
+
+func (r root) isWork() bool {
+	return path.Base(r.modName) == "go.work"
+}
+
+func (r root) dir() string {
+	return path.Dir(r.modName)
+}
+
+func (r root) sumName() string {
+	if r.isWork() {
+		return path.Join(r.dir(), "go.work.sum")
+	}
+	return path.Join(r.dir(), "go.sum")
+}
+
+// findRoots returns the module and workspace roots in arc. If modName is not
+// empty, only the root for that go.mod file is returned.
+func findRoots(arc *txtar.Archive, modName string) ([]root, error) {
+	var roots []root
+	for _, f := range arc.Files {
+		if modName != "" {
+			if f.Name == modName {
+				roots = append(roots, root{modName: f.Name})
+			}
+			continue
+		}
+		if base := path.Base(f.Name); base == "go.mod" || base == "go.work" {
+			roots = append(roots, root{modName: f.Name})
+		}
+	}
+	if len(roots) == 0 && modName != "" {
+		return nil, fmt.Errorf("%s not found", modName)
+	}
+	return roots, nil
+}
+
+// fixArchive updates or inserts a go.sum or go.work.sum file for each module
+// and workspace root in arc. It extracts arc to a temporary directory, runs
+// the script prelude in the archive comment if cfg.script is set, runs the
+// go command in each root to compute checksums, then copies the sum files
+// back into arc.
+//
+// If cfg.merge is set, sum files are removed before running the go command,
+// then merged into the archive's sum files with mergeSum, honoring keep
+// directives in the archive comment. fixArchive returns the changed lines,
+// each prefixed with the sum file name. With cfg.tidy, changed go.mod lines
+// are returned the same way; with cfg.vendor, changed vendored files are
+// listed. If the script prelude edits a go.mod file in the archive, -tidy
+// is refused, since the prelude's edits would be written back too.
+//
+// Script tests often include go.mod files that are meant to make the go
+// command fail. So the go command only needs to succeed in the primary
+// root: the one named by cfg.modName, the one the script prelude ends in,
+// or failing those, the root at the top of the archive. If the go command
+// fails in another root, that root's files are left alone, and fixArchive
+// returns a warning instead of an error.
+func fixArchive(arc *txtar.Archive, cfg *config) (changes, warnings []string, err error) {
+	roots, err := findRoots(arc, cfg.modName)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	primary := make(map[root]bool)
+	if cfg.modName != "" {
+		primary[root{modName: cfg.modName}] = true
 	}
 
-	sumName := "go.sum"
-	if strings.Contains(modName, "/") {
-		sumName = path.Join(path.Dir(modName), "go.sum")
+	workDir, err := ioutil.TempDir("", "fixtestsum")
+	if err != nil {
+		return nil, nil, err
 	}
-	sumIndex := -1
-	modIndex := -1
-	for i, f := range arc.Files {
-		if f.Name == sumName {
-			sumIndex = i
-		} else if f.Name == modName {
-			modIndex = i
+	defer os.RemoveAll(workDir)
+
+	// Extract files where cmd/go's script tests would, so paths in the
+	// comment like $WORK/gopath/src/m have the same meaning.
+	dir := filepath.Join(workDir, "gopath", "src")
+	for _, f := range arc.Files {
+		outPath := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(outPath), 0777); err != nil {
+			return nil, nil, err
+		}
+		if err := ioutil.WriteFile(outPath, f.Data, 0666); err != nil {
+			return nil, nil, err
 		}
-		outPath := filepath.Join(dir, f.Name)
-		if strings.Contains(f.Name, "/") {
-			if err := os.MkdirAll(filepath.Dir(outPath), 0777); err != nil {
-				return err
+	}
+
+	env := cfg.env
+	if cfg.script {
+		st, err := runScriptPrelude(arc.Comment, workDir, dir, cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		env = st.goEnv(cfg.env)
+		// The script may create a go.mod file that isn't in the archive or
+		// change to a directory whose root wouldn't otherwise be fixed.
+		if r, ok := st.root(); ok && cfg.modName == "" {
+			if !hasRoot(roots, r) {
+				roots = append(roots, r)
 			}
+			primary[r] = true
 		}
-		if err := ioutil.WriteFile(outPath, f.Data, 0666); err != nil {
+		if cfg.tidy {
+			if err := checkPreludeModEdits(arc, roots, dir); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if len(primary) == 0 {
+		for _, r := range roots {
+			if r.dir() == "." {
+				primary[r] = true
+			}
+		}
+	}
+	if len(roots) == 0 {
+		return nil, nil, fmt.Errorf("go.mod file not found")
+	}
+	// Fix module roots before workspace roots, since a workspace only records
+	// checksums its modules' go.sum files don't already have.
+	sort.SliceStable(roots, func(i, j int) bool {
+		return !roots[i].isWork() && roots[j].isWork()
+	})
+
+	if cfg.merge {
+		// Start from empty sum files so that wrong hashes in the archive
+		// don't cause errors and unneeded lines aren't carried over.
+		for _, r := range roots {
+			if err := os.Remove(filepath.Join(dir, filepath.FromSlash(r.sumName()))); err != nil && !os.IsNotExist(err) {
+				return nil, nil, err
+			}
+		}
+	}
+
+	keep := parseKeep(arc.Comment)
+	failed := make(map[root]bool)
+	for _, r := range roots {
+		var cmds [][]string
+		switch {
+		case r.isWork():
+			cmds = append(cmds, []string{"mod", "download"})
+		case cfg.tidy:
+			cmds = append(cmds, []string{"mod", "tidy"})
+		default:
+			cmds = append(cmds, []string{"list", "-mod=mod", "all"})
+		}
+		if cfg.vendor {
+			if r.isWork() {
+				cmds = append(cmds, []string{"work", "vendor"})
+			} else {
+				cmds = append(cmds, []string{"mod", "vendor"})
+			}
+		}
+		for _, args := range cmds {
+			cmd := exec.Command(cfg.goCmd, args...)
+			cmd.Env = env
+			if !r.isWork() {
+				cmd.Env = append(env[:len(env):len(env)], "GOWORK=off")
+			}
+			cmd.Dir = filepath.Join(dir, filepath.FromSlash(r.dir()))
+			// Archives are fixed in parallel, so collect output rather than
+			// interleaving it.
+			stderr := &bytes.Buffer{}
+			cmd.Stderr = stderr
+			if err := cmd.Run(); err != nil {
+				err = fmt.Errorf("running '%s' in %s: %w\n%s", strings.Join(cmd.Args, " "), r.dir(), err, bytes.TrimSpace(stderr.Bytes()))
+				if primary[r] || len(primary) == 0 && len(failed) == len(roots)-1 {
+					// With no primary root, fail only if no root could be fixed.
+					return nil, nil, err
+				}
+				warnings = append(warnings, fmt.Sprintf("%s not fixed: %v", r.modName, err))
+				failed[r] = true
+				break
+			}
+		}
+	}
+
+	for _, r := range roots {
+		if failed[r] {
+			continue
+		}
+		if oldModData, ok := getFile(arc, r.modName); ok && cfg.tidy && !r.isWork() {
+			// A go.mod file created by the script prelude isn't written back,
+			// since the archive doesn't have it.
+			modData, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(r.modName)))
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, c := range lineChanges(oldModData, modData) {
+				changes = append(changes, r.modName+": "+c)
+			}
+			setFile(arc, r.modName, modData, "")
+		}
+		sumData, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(r.sumName())))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+		oldSumData, hadSum := getFile(arc, r.sumName())
+		if cfg.merge {
+			merged, sumChanges := mergeSum(oldSumData, sumData, keep)
+			for _, c := range sumChanges {
+				changes = append(changes, r.sumName()+": "+c)
+			}
+			if hadSum || len(merged) > 0 {
+				setFile(arc, r.sumName(), merged, r.modName)
+			}
+		} else if err == nil {
+			// If the sum file doesn't exist, the go command didn't need any
+			// checksums.
+			setFile(arc, r.sumName(), sumData, r.modName)
+		}
+		if cfg.vendor {
+			vendorName := path.Join(r.dir(), "vendor")
+			vendorChanges, err := setDir(arc, vendorName, filepath.Join(dir, filepath.FromSlash(vendorName)), r.sumName())
+			if err != nil {
+				return nil, nil, err
+			}
+			changes = append(changes, vendorChanges...)
+		}
+	}
+	return changes, warnings, nil
+}
+
+// checkPreludeModEdits returns an error if the script prelude changed or
+// removed a go.mod file in arc. 'go mod tidy' rewrites the whole file, so
+// its output can't be written back without also saving the prelude's edits,
+// like 'go mod edit -replace', which belong to the test, not the archive.
+func checkPreludeModEdits(arc *txtar.Archive, roots []root, dir string) error {
+	for _, r := range roots {
+		data, ok := getFile(arc, r.modName)
+		if !ok || r.isWork() {
+			continue
+		}
+		extracted, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(r.modName)))
+		if err != nil && !os.IsNotExist(err) {
 			return err
 		}
+		if err != nil || !bytes.Equal(extracted, data) {
+			return fmt.Errorf("can't use -tidy: the script prelude changes %s", r.modName)
+		}
 	}
-	if modIndex < 0 {
-		return fmt.Errorf("go.mod file not found")
+	return nil
+}
+
+// lineChanges returns the lines removed from old and added in new, each
+// prefixed with '-' or '+', in the same form as mergeSum's changes. Blank
+// lines are omitted.
+func lineChanges(old, new []byte) []string {
+	d := diff.Unified("old", "new", old, new)
+	if d == nil {
+		return nil
+	}
+	var changes []string
+	// Skip the "---" and "+++" header lines.
+	for _, line := range strings.Split(string(d), "\n")[2:] {
+		if (strings.HasPrefix(line, "-") || strings.HasPrefix(line, "+")) && strings.TrimSpace(line[1:]) != "" {
+			changes = append(changes, line)
+		}
 	}
+	return changes
+}
 
-	modRootDir := filepath.Dir(filepath.Join(dir, modName))
-	cmd := exec.Command("go", "list", "-mod=mod", "all")
-	cmd.Dir = modRootDir
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("running 'go list -mod=mod all': %w", err)
+// getFile returns the content of the file with the given name in arc.
+func getFile(arc *txtar.Archive, name string) ([]byte, bool) {
+	for _, f := range arc.Files {
+		if f.Name == name {
+			return f.Data, true
+		}
 	}
+	return nil, false
+}
 
-	sumData, err := ioutil.ReadFile(filepath.Join(dir, sumName))
-	if err != nil {
-		return err
+func hasRoot(roots []root, r root) bool {
+	for _, other := range roots {
+		if other == r {
+			return true
+		}
 	}
-	if sumIndex >= 0 {
-		arc.Files[sumIndex].Data = sumData
-	} else {
-		sumFile := txtar.File{Name: sumName, Data: sumData}
-		arc.Files = append(arc.Files[:modIndex+1], append([]txtar.File{sumFile}, arc.Files[modIndex+1:]...)...)
+	return false
+}
+
+// setFile replaces the content of the file with the given name in arc.
+// If there is no such file, a new file is inserted after the file named
+// after, or at the end of the archive if that's not present either.
+func setFile(arc *txtar.Archive, name string, data []byte, after string) {
+	afterIndex := len(arc.Files) - 1
+	for i, f := range arc.Files {
+		if f.Name == name {
+			arc.Files[i].Data = data
+			return
+		}
+		if f.Name == after {
+			afterIndex = i
+		}
+	}
+	file := txtar.File{Name: name, Data: data}
+	arc.Files = append(arc.Files[:afterIndex+1], append([]txtar.File{file}, arc.Files[afterIndex+1:]...)...)
+}
+
+// setDir replaces the files in arc within the directory dirName with the
+// files in localDir. Files already in arc keep their positions, and files
+// no longer in localDir are removed. New files are inserted in sorted order
+// after the last remaining file in the directory, or after the file named
+// after if there are none. setDir returns the names of files it added,
+// updated, or removed, each followed by what happened to it.
+func setDir(arc *txtar.Archive, dirName, localDir, after string) (changes []string, err error) {
+	local := make(map[string][]byte)
+	err = filepath.Walk(localDir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, p)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		local[path.Join(dirName, filepath.ToSlash(rel))] = data
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	prefix := dirName + "/"
+	if dirName == "." {
+		prefix = ""
+	}
+	files := arc.Files[:0]
+	lastName := after
+	for _, f := range arc.Files {
+		if !strings.HasPrefix(f.Name, prefix) {
+			files = append(files, f)
+			continue
+		}
+		data, ok := local[f.Name]
+		if !ok {
+			changes = append(changes, f.Name+": removed")
+			continue
+		}
+		if !bytes.Equal(data, f.Data) {
+			changes = append(changes, f.Name+": updated")
+		}
+		delete(local, f.Name)
+		files = append(files, txtar.File{Name: f.Name, Data: data})
+		lastName = f.Name
+	}
+	arc.Files = files
+
+	var newNames []string
+	for name := range local {
+		newNames = append(newNames, name)
+	}
+	sort.Strings(newNames)
+	for _, name := range newNames {
+		setFile(arc, name, local[name], lastName)
+		changes = append(changes, name+": added")
+		lastName = name
 	}
-	return ioutil.WriteFile(testPath, txtar.Format(arc), 0666)
+	return changes, nil
 }
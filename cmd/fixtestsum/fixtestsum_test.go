@@ -0,0 +1,388 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jayconrod/misc/txtarproxy"
+	"golang.org/x/tools/txtar"
+)
+
+// fixtures are modules served to the go command by testConfig's proxy.
+var fixtures = fstest.MapFS{
+	"example.com_a_v1.0.0.txt": {Data: []byte("-- go.mod --\nmodule example.com/a\n\ngo 1.16\n-- a.go --\npackage a\n")},
+	"example.com_a_v1.1.0.txt": {Data: []byte("-- go.mod --\nmodule example.com/a\n\ngo 1.16\n-- a.go --\npackage a\n")},
+}
+
+// testConfig returns a config that runs the go command offline with a
+// temporary module cache, fetching modules from a proxy serving fixtures.
+func testConfig(t *testing.T) *config {
+	t.Helper()
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	proxyURL, _ := txtarproxy.StartTestProxy(t, fixtures)
+	gopath := t.TempDir()
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "GO") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		"GOENV=off",
+		"GOPATH="+gopath,
+		"GOMODCACHE="+filepath.Join(gopath, "pkg", "mod"),
+		"GOTOOLCHAIN=local",
+		"GOFLAGS=-modcacherw",
+		"GOPROXY="+proxyURL,
+		"GOSUMDB=off",
+	)
+	return &config{goCmd: "go", env: env, script: true, merge: true}
+}
+
+func TestFixArchiveTidy(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.tidy = true
+
+	arc := txtar.Parse([]byte(`-- go.mod --
+module m
+
+go 1.16
+-- m.go --
+package m
+
+import _ "example.com/a"
+`))
+	changes, _, err := fixArchive(arc, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const wantMod = "module m\n\ngo 1.16\n\nrequire example.com/a v1.1.0\n"
+	if got, _ := getFile(arc, "go.mod"); string(got) != wantMod {
+		t.Errorf("got go.mod:\n%s\nwant:\n%s", got, wantMod)
+	}
+	got := strings.Join(changes, "\n")
+	for _, want := range []string{
+		"go.mod: +require example.com/a v1.1.0",
+		"go.sum: +example.com/a v1.1.0 h1:",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("changes do not contain %q:\n%s", want, got)
+		}
+	}
+
+	// Tidying after the prelude edits go.mod would save the edits too.
+	arc = txtar.Parse([]byte(`go mod edit -replace example.com/a=example.com/a@v1.0.0
+go build
+-- go.mod --
+module m
+
+go 1.16
+
+require example.com/a v1.1.0
+-- m.go --
+package m
+
+import _ "example.com/a"
+`))
+	_, _, err = fixArchive(arc, cfg)
+	if want := "can't use -tidy: the script prelude changes go.mod"; err == nil || err.Error() != want {
+		t.Errorf("with prelude edits: got error %v; want %q", err, want)
+	}
+	cfg.tidy = false
+	if _, _, err := fixArchive(arc, cfg); err != nil {
+		t.Errorf("with prelude edits and no -tidy: %v", err)
+	}
+	if got, _ := getFile(arc, "go.mod"); strings.Contains(string(got), "replace") {
+		t.Errorf("go.mod has prelude edits:\n%s", got)
+	}
+}
+
+func TestFindRoots(t *testing.T) {
+	arc := txtar.Parse([]byte(`-- go.mod --
+-- a.go --
+-- sub/go.mod --
+-- sub/go.work --
+-- notgo.mod --
+`))
+	for _, tt := range []struct {
+		modName, want, wantErr string
+	}{
+		{modName: "", want: "go.mod,sub/go.mod,sub/go.work"},
+		{modName: "sub/go.mod", want: "sub/go.mod"},
+		{modName: "other/go.mod", wantErr: "other/go.mod not found"},
+	} {
+		roots, err := findRoots(arc, tt.modName)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("findRoots(%q): got error %v; want %q", tt.modName, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, r := range roots {
+			names = append(names, r.modName)
+		}
+		if got := strings.Join(names, ","); got != tt.want {
+			t.Errorf("findRoots(%q): got %s; want %s", tt.modName, got, tt.want)
+		}
+	}
+}
+
+// Modules for TestFixArchiveRoots. goodMod can be fixed; badMod requires
+// a module the proxy doesn't have, so the go command fails.
+const (
+	goodMod = "module m\n\ngo 1.16\n\nrequire example.com/a v1.0.0\n"
+	badMod  = "module m\n\ngo 1.16\n\nrequire example.com/missing v1.0.0\n"
+)
+
+func TestFixArchiveRoots(t *testing.T) {
+	cfg := testConfig(t)
+	for _, tt := range []struct {
+		desc, archive string
+		modName       string
+		wantSums      string // names of files followed by sum files, in order
+		wantWarning   string
+		wantErr       string
+	}{
+		{
+			desc: "top_primary_other_fails",
+			archive: "-- go.mod --\n" + goodMod +
+				"-- m.go --\npackage m\n" +
+				"-- b/go.mod --\n" + badMod,
+			wantSums:    "go.mod go.sum m.go b/go.mod",
+			wantWarning: "b/go.mod not fixed: running 'go list -mod=mod all' in b",
+		},
+		{
+			desc: "top_primary_fails",
+			archive: "-- go.mod --\n" + badMod +
+				"-- b/go.mod --\n" + goodMod,
+			wantErr: "running 'go list -mod=mod all' in .",
+		},
+		{
+			desc: "script_primary_fails",
+			archive: "cd b\ngo build\n" +
+				"-- go.mod --\n" + goodMod +
+				"-- b/go.mod --\n" + badMod,
+			wantErr: "running 'go list -mod=mod all' in b",
+		},
+		{
+			desc: "modname_primary",
+			archive: "-- go.mod --\n" + badMod +
+				"-- b/go.mod --\n" + goodMod +
+				"-- b/b.go --\npackage b\n",
+			modName:  "b/go.mod",
+			wantSums: "go.mod b/go.mod b/go.sum b/b.go",
+		},
+		{
+			desc: "no_primary_one_fails",
+			archive: "-- x/go.mod --\n" + goodMod +
+				"-- y/go.mod --\n" + badMod,
+			wantSums:    "x/go.mod x/go.sum y/go.mod",
+			wantWarning: "y/go.mod not fixed",
+		},
+		{
+			desc: "no_primary_all_fail",
+			archive: "-- x/go.mod --\n" + badMod +
+				"-- y/go.mod --\n" + badMod,
+			wantErr: "running 'go list -mod=mod all' in y",
+		},
+		{
+			desc:    "no_roots",
+			archive: "-- a.go --\npackage a\n",
+			wantErr: "go.mod file not found",
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := *cfg
+			cfg.modName = tt.modName
+			arc := txtar.Parse([]byte(tt.archive))
+			changes, warnings, err := fixArchive(arc, &cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v; want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, f := range arc.Files {
+				names = append(names, f.Name)
+			}
+			if got := strings.Join(names, " "); got != tt.wantSums {
+				t.Errorf("got files %s; want %s", got, tt.wantSums)
+			}
+			if got := strings.Join(warnings, "\n"); !strings.Contains(got, tt.wantWarning) || (tt.wantWarning == "") != (got == "") {
+				t.Errorf("got warnings %q; want warning containing %q", got, tt.wantWarning)
+			}
+			for _, c := range changes {
+				if !strings.HasSuffix(strings.Fields(c)[0], "go.sum:") {
+					t.Errorf("unexpected change %q", c)
+				}
+			}
+		})
+	}
+}
+
+func TestFixTestCheck(t *testing.T) {
+	cfg := testConfig(t)
+	testPath := filepath.Join(t.TempDir(), "test.txt")
+	const archive = "-- go.mod --\n" + goodMod +
+		"-- go.sum --\nexample.com/a v1.0.0 h1:WRONG=\n" +
+		"-- m.go --\npackage m\n\nimport _ \"example.com/a\"\n"
+	if err := ioutil.WriteFile(testPath, []byte(archive), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// In check mode, the archive is reported but not written.
+	cfg.check = true
+	changed, report, _, err := fixTest(testPath, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Errorf("check: archive with wrong hash is not stale")
+	}
+	for _, want := range []string{
+		testPath + ": go.sum: -example.com/a v1.0.0 h1:WRONG=\n",
+		testPath + ": go.sum: +example.com/a v1.0.0 h1:",
+		testPath + ": go.sum: +example.com/a v1.0.0/go.mod h1:",
+	} {
+		if !strings.Contains(string(report), want) {
+			t.Errorf("check: report does not contain %q:\n%s", want, report)
+		}
+	}
+	if data, _ := ioutil.ReadFile(testPath); string(data) != archive {
+		t.Errorf("check: archive was written:\n%s", data)
+	}
+
+	// With -diff, the report is a unified diff of the archive.
+	cfg.diff = true
+	if _, report, _, err = fixTest(testPath, cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"--- a/" + filepath.ToSlash(testPath) + "\n",
+		"-example.com/a v1.0.0 h1:WRONG=\n",
+		"+example.com/a v1.0.0/go.mod h1:",
+	} {
+		if !strings.Contains(string(report), want) {
+			t.Errorf("diff: report does not contain %q:\n%s", want, report)
+		}
+	}
+
+	// Otherwise, the archive is fixed, and fixing it again changes nothing.
+	cfg.check, cfg.diff = false, false
+	if changed, _, _, err = fixTest(testPath, cfg); err != nil || !changed {
+		t.Fatalf("fix: got changed %v, error %v; want changed", changed, err)
+	}
+	if data, _ := ioutil.ReadFile(testPath); strings.Contains(string(data), "WRONG") {
+		t.Errorf("fix: archive was not written:\n%s", data)
+	}
+	if changed, report, _, err = fixTest(testPath, cfg); err != nil || changed || len(report) > 0 {
+		t.Errorf("second fix: got changed %v, report %q, error %v; want no changes", changed, report, err)
+	}
+}
+
+func TestFixArchiveVendor(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.vendor = true
+	arc := txtar.Parse([]byte(`-- go.mod --
+` + goodMod + `-- m.go --
+package m
+
+import _ "example.com/a"
+-- vendor/example.com/old/old.go --
+package old
+`))
+	changes, _, err := fixArchive(arc, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range arc.Files {
+		// Newer versions of the go command vendor go.mod files too.
+		if f.Name != "vendor/example.com/a/go.mod" {
+			names = append(names, f.Name)
+		}
+	}
+	// Vendored files replace the old ones and follow go.sum, since no
+	// vendored file was kept to insert them after.
+	if got, want := strings.Join(names, " "), "go.mod go.sum vendor/example.com/a/a.go vendor/modules.txt m.go"; got != want {
+		t.Errorf("got files %s; want %s", got, want)
+	}
+	got := strings.Join(changes, "\n")
+	for _, want := range []string{
+		"vendor/example.com/old/old.go: removed",
+		"vendor/example.com/a/a.go: added",
+		"vendor/modules.txt: added",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("changes do not contain %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestSetDir(t *testing.T) {
+	localDir := t.TempDir()
+	for name, data := range map[string]string{
+		"modules.txt": "new\n",
+		"kept.go":     "same\n",
+		"b/b.go":      "b\n",
+		"a/a.go":      "a\n",
+	} {
+		p := filepath.Join(localDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	arc := txtar.Parse([]byte(`-- go.mod --
+-- go.sum --
+-- vendor/modules.txt --
+old
+-- vendor/z/z.go --
+z
+-- vendor/kept.go --
+same
+-- m.go --
+`))
+	changes, err := setDir(arc, "vendor", localDir, "go.sum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range arc.Files {
+		names = append(names, f.Name)
+	}
+	// Existing files keep their positions; new files follow the last of
+	// them in sorted order.
+	if got, want := strings.Join(names, " "), "go.mod go.sum vendor/modules.txt vendor/kept.go vendor/a/a.go vendor/b/b.go m.go"; got != want {
+		t.Errorf("got files %s; want %s", got, want)
+	}
+	if got, want := strings.Join(changes, ","), "vendor/modules.txt: updated,vendor/z/z.go: removed,vendor/a/a.go: added,vendor/b/b.go: added"; got != want {
+		t.Errorf("got changes %s; want %s", got, want)
+	}
+
+	// Without a local directory, every file in the archive's is removed.
+	changes, err = setDir(arc, "vendor", filepath.Join(localDir, "missing"), "go.sum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(arc.Files), 3; got != want || len(changes) != 4 {
+		t.Errorf("with missing directory: got %d files, %d changes; want %d files, 4 changes", got, len(changes), want)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// scriptState is the state of a script test after its prelude has run: the
+// commands in the archive comment before the first go command other than
+// 'go mod edit'. The prelude often creates or edits go.mod files, sets
+// environment variables, or changes to a subdirectory, all of which affect
+// the checksums the go command needs.
+//
+// Like cmd/go's script tests, the archive is extracted into
+// $WORK/gopath/src, which is also the initial directory.
+type scriptState struct {
+	workDir, srcDir string
+
+	// dir is the current directory, changed by cd.
+	dir string
+
+	// env holds variables set by env commands, as KEY=VALUE pairs.
+	env []string
+}
+
+// scriptIgnoredEnv lists variables that scripts may set but that fixtestsum
+// controls itself, since they determine where modules are downloaded from
+// and stored. Scripts usually point these at cmd/go's test proxy.
+var scriptIgnoredEnv = map[string]bool{
+	"GOENV":       true,
+	"GOMODCACHE":  true,
+	"GONOPROXY":   true,
+	"GONOSUMDB":   true,
+	"GOPATH":      true,
+	"GOPRIVATE":   true,
+	"GOPROXY":     true,
+	"GOSUMDB":     true,
+	"GOTOOLCHAIN": true,
+}
+
+// runScriptPrelude interprets the prelude of the script in comment. The
+// archive must already be extracted into srcDir.
+//
+// Only cd, env, cp, mkdir, rm, and 'go mod edit' are interpreted. Lines
+// starting with other words are ignored: they're either commands that don't
+// affect the go command or prose, since archives that aren't script tests
+// may have any text in their comments. Lines with conditions like [short]
+// are ignored since conditions can't be evaluated outside cmd/go's test
+// harness.
+//
+// Commands may only change files within workDir, and variables that aren't
+// set by the script or cmd/go's test harness are errors, so a script can't
+// affect anything outside the extracted archive.
+func runScriptPrelude(comment []byte, workDir, srcDir string, cfg *config) (st *scriptState, err error) {
+	st = &scriptState{workDir: workDir, srcDir: srcDir, dir: srcDir}
+Lines:
+	for i, line := range strings.Split(string(comment), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "[") {
+			continue
+		}
+		neg := false
+		if strings.HasPrefix(line, "!") || strings.HasPrefix(line, "?") {
+			neg = true
+			line = strings.TrimSpace(line[1:])
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "skip", "stop":
+			break Lines
+		case "go":
+			if len(fields) < 3 || fields[1] != "mod" || fields[2] != "edit" {
+				break Lines
+			}
+		case "env":
+			// Values of variables fixtestsum controls don't matter, and they
+			// often refer to variables only cmd/go's test harness sets, like
+			// $GOPROXY, so drop them before expanding the line.
+			kept := fields[:1]
+			for _, f := range fields[1:] {
+				if eq := strings.Index(f, "="); eq < 0 || !scriptIgnoredEnv[f[:eq]] {
+					kept = append(kept, f)
+				}
+			}
+			line = strings.Join(kept, " ")
+		case "cd", "cp", "mkdir", "rm":
+		default:
+			continue
+		}
+
+		args, err := st.parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("comment line %d: %w", i+1, err)
+		}
+		if err := st.run(args, neg, cfg); err != nil {
+			return nil, fmt.Errorf("comment line %d: %s: %w", i+1, args[0], err)
+		}
+	}
+	return st, nil
+}
+
+// run executes a single prelude command.
+func (st *scriptState) run(args []string, neg bool, cfg *config) error {
+	switch args[0] {
+	case "cd":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: cd dir")
+		}
+		dir, err := st.abs(args[1])
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Stat(dir); err != nil {
+			return err
+		} else if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", args[1])
+		}
+		st.dir = dir
+
+	case "env":
+		for _, kv := range args[1:] {
+			if strings.Contains(kv, "=") {
+				st.env = append(st.env, kv)
+			}
+		}
+
+	case "cp":
+		if len(args) < 3 {
+			return fmt.Errorf("usage: cp src... dst")
+		}
+		dst, err := st.abs(args[len(args)-1])
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(dst)
+		dstDir := err == nil && fi.IsDir()
+		if len(args) > 3 && !dstDir {
+			return fmt.Errorf("destination %s is not a directory", args[len(args)-1])
+		}
+		for _, src := range args[1 : len(args)-1] {
+			if src == "stdout" || src == "stderr" {
+				// Output of earlier commands isn't known here.
+				continue
+			}
+			srcPath, err := st.abs(src)
+			if err != nil {
+				return err
+			}
+			data, err := ioutil.ReadFile(srcPath)
+			if err != nil {
+				return err
+			}
+			target := dst
+			if dstDir {
+				target = filepath.Join(dst, filepath.Base(srcPath))
+			}
+			if err := ioutil.WriteFile(target, data, 0666); err != nil {
+				return err
+			}
+		}
+
+	case "mkdir":
+		for _, name := range args[1:] {
+			dir, err := st.abs(name)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(dir, 0777); err != nil {
+				return err
+			}
+		}
+
+	case "rm":
+		for _, name := range args[1:] {
+			p, err := st.abs(name)
+			if err != nil {
+				return err
+			}
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+		}
+
+	case "go":
+		// runScriptPrelude only runs 'go mod edit'.
+		cmd := exec.Command(cfg.goCmd, args[1:]...)
+		cmd.Dir = st.dir
+		cmd.Env = st.goEnv(cfg.env)
+		stderr := &bytes.Buffer{}
+		cmd.Stderr = stderr
+		if err := cmd.Run(); err != nil && !neg {
+			return fmt.Errorf("%w\n%s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+	}
+	return nil
+}
+
+// abs returns the absolute path of a script argument, relative to the
+// current directory. The path must be within st.workDir.
+func (st *scriptState) abs(name string) (string, error) {
+	p := filepath.FromSlash(name)
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(st.dir, p)
+	}
+	p = filepath.Clean(p)
+	if rel, err := filepath.Rel(st.workDir, p); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside $WORK", name)
+	}
+	return p, nil
+}
+
+// goEnv returns base with variables set by the script added. GOFLAGS from
+// the script are appended to GOFLAGS in base rather than replacing them.
+func (st *scriptState) goEnv(base []string) []string {
+	env := base[:len(base):len(base)]
+	for _, kv := range st.env {
+		eq := strings.Index(kv, "=")
+		key, value := kv[:eq], kv[eq+1:]
+		if scriptIgnoredEnv[key] {
+			continue
+		}
+		if key == "GOFLAGS" {
+			for _, baseKV := range base {
+				if strings.HasPrefix(baseKV, "GOFLAGS=") {
+					value = strings.TrimSpace(strings.TrimPrefix(baseKV, "GOFLAGS=") + " " + value)
+				}
+			}
+		}
+		env = append(env, key+"="+value)
+	}
+	return env
+}
+
+// root returns the module or workspace root the go command would use in
+// the script's current directory, if that's within the extracted archive.
+func (st *scriptState) root() (root, bool) {
+	for _, name := range []string{"go.mod", "go.work"} {
+		for dir := st.dir; ; dir = filepath.Dir(dir) {
+			rel, err := filepath.Rel(st.srcDir, dir)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				break
+			}
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				return root{modName: filepath.ToSlash(filepath.Join(rel, name))}, true
+			}
+		}
+	}
+	return root{}, false
+}
+
+// lookup returns the value of a variable for expansion in script arguments.
+// It returns false if the variable is neither set by the script nor one of
+// the variables cmd/go's test harness sets that fixtestsum can reproduce.
+func (st *scriptState) lookup(key string) (string, bool) {
+	for i := len(st.env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(st.env[i], key+"=") {
+			return st.env[i][len(key)+1:], true
+		}
+	}
+	switch key {
+	case "WORK":
+		return st.workDir, true
+	case "GOPATH":
+		return filepath.Join(st.workDir, "gopath"), true
+	case "PWD":
+		return st.dir, true
+	case "/":
+		return string(filepath.Separator), true
+	case ":":
+		return string(filepath.ListSeparator), true
+	}
+	return "", false
+}
+
+// parseLine splits a script line into arguments. As in cmd/go's script
+// tests, arguments are separated by spaces, single quotes protect spaces
+// and variables (a doubled quote within quotes is a literal quote), and
+// $VAR and ${VAR} are expanded outside quotes. A trailing '&' is ignored.
+// Expanding a variable that isn't set is an error.
+func (st *scriptState) parseLine(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg, quoted := false, false
+	var unset string
+	expand := func(key string) string {
+		value, ok := st.lookup(key)
+		if !ok && unset == "" {
+			unset = key
+		}
+		return value
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quoted && c == '\'' && i+1 < len(line) && line[i+1] == '\'':
+			arg.WriteByte('\'')
+			i++
+		case c == '\'':
+			quoted = !quoted
+			inArg = true
+		case quoted:
+			arg.WriteByte(c)
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		case c == '#' && !inArg:
+			i = len(line)
+		default:
+			// Expand variables up to the next space or quote.
+			j := i
+			for j < len(line) && line[j] != ' ' && line[j] != '\t' && line[j] != '\'' {
+				j++
+			}
+			arg.WriteString(os.Expand(line[i:j], expand))
+			inArg = true
+			i = j - 1
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if unset != "" {
+		return nil, fmt.Errorf("$%s is not set", unset)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	if len(args) > 0 && args[len(args)-1] == "&" {
+		args = args[:len(args)-1]
+	}
+	return args, nil
+}
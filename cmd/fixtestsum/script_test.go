@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	st := &scriptState{
+		workDir: "/work",
+		dir:     "/work/gopath/src",
+		env:     []string{"A=a", "B=b c", "A=a2"},
+	}
+	for _, tt := range []struct {
+		line    string
+		want    []string
+		wantErr string
+	}{
+		{line: "cd dir", want: []string{"cd", "dir"}},
+		{line: "  cp \ta  b ", want: []string{"cp", "a", "b"}},
+		{line: "env 'X=a b' Y=", want: []string{"env", "X=a b", "Y="}},
+		{line: "cp 'it''s' x", want: []string{"cp", "it's", "x"}},
+		{line: "cp '' x", want: []string{"cp", "", "x"}},
+		{line: "cp a'b c'd e", want: []string{"cp", "ab cd", "e"}},
+		{line: "cp $A ${B} x", want: []string{"cp", "a2", "b c", "x"}},
+		{line: "cp $WORK${/}x $GOPATH/y", want: []string{"cp", "/work/x", "/work/gopath/y"}},
+		{line: "cp '$A' x$A", want: []string{"cp", "$A", "xa2"}},
+		{line: "cd $PWD", want: []string{"cd", "/work/gopath/src"}},
+		{line: "rm a # comment", want: []string{"rm", "a"}},
+		{line: "rm a#b", want: []string{"rm", "a#b"}},
+		{line: "rm '#' x", want: []string{"rm", "#", "x"}},
+		{line: "go mod edit &", want: []string{"go", "mod", "edit"}},
+		{line: "cp 'a", wantErr: "unterminated quote"},
+		{line: "rm $GOCACHE/x", wantErr: "$GOCACHE is not set"},
+		{line: "rm ${UNSET}", wantErr: "$UNSET is not set"},
+	} {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := st.parseLine(tt.line)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got %q, %v; want error %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunScriptPrelude(t *testing.T) {
+	for _, tt := range []struct {
+		desc, comment string
+		wantDir       string
+		wantEnv       []string
+		wantFiles     []string
+		wantErr       string
+	}{
+		{
+			desc:    "prose",
+			comment: "This archive doesn't use scripts.\nIt's just a module.\n",
+			wantDir: "gopath/src",
+		},
+		{
+			desc: "commands",
+			comment: `# Set up a second module.
+env GOFLAGS=-mod=mod GOPROXY=$GOPROXY/quiet
+[short] skip
+mkdir b
+cp go.mod b/go.mod
+cp $WORK/gopath/src/a.go b
+cd b
+exec true
+rm a.go
+go list -m
+cd ..
+`,
+			wantDir:   "gopath/src/b",
+			wantEnv:   []string{"GOFLAGS=-mod=mod"},
+			wantFiles: []string{"gopath/src/a.go", "gopath/src/b/go.mod", "gopath/src/go.mod"},
+		},
+		{
+			desc:      "stop",
+			comment:   "stop 'it''s done'\nrm go.mod\n",
+			wantDir:   "gopath/src",
+			wantFiles: []string{"gopath/src/a.go", "gopath/src/go.mod"},
+		},
+		{
+			desc:    "rm_outside",
+			comment: "rm /x\n",
+			wantErr: "comment line 1: rm: /x is outside $WORK",
+		},
+		{
+			desc:    "rm_relative_outside",
+			comment: "rm ../../../x\n",
+			wantErr: "comment line 1: rm: ../../../x is outside $WORK",
+		},
+		{
+			desc:    "cp_outside",
+			comment: "cp go.mod $WORK/../x\n",
+			wantErr: "is outside $WORK",
+		},
+		{
+			desc:    "unset",
+			comment: "rm $GOCACHE/x\n",
+			wantErr: "comment line 1: $GOCACHE is not set",
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			workDir := t.TempDir()
+			srcDir := filepath.Join(workDir, "gopath", "src")
+			if err := os.MkdirAll(srcDir, 0777); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"go.mod", "a.go"} {
+				if err := ioutil.WriteFile(filepath.Join(srcDir, name), nil, 0666); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			st, err := runScriptPrelude([]byte(tt.comment), workDir, srcDir, &config{goCmd: "false"})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v; want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(workDir, filepath.FromSlash(tt.wantDir)); st.dir != want {
+				t.Errorf("got dir %s; want %s", st.dir, want)
+			}
+			if strings.Join(st.env, " ") != strings.Join(tt.wantEnv, " ") {
+				t.Errorf("got env %q; want %q", st.env, tt.wantEnv)
+			}
+			if tt.wantFiles != nil {
+				var files []string
+				filepath.Walk(workDir, func(p string, fi os.FileInfo, err error) error {
+					if err == nil && !fi.IsDir() {
+						rel, _ := filepath.Rel(workDir, p)
+						files = append(files, filepath.ToSlash(rel))
+					}
+					return err
+				})
+				if strings.Join(files, " ") != strings.Join(tt.wantFiles, " ") {
+					t.Errorf("got files %q; want %q", files, tt.wantFiles)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// keepDirective marks go.sum lines in an archive that fixtestsum must not
+// change or remove, usually because they're intentionally wrong. It appears
+// in the archive comment, followed by a module path and optionally a
+// version, for example:
+//
+//	# fixtestsum:keep example.com/a v1.0.0
+//
+// A version without a "/go.mod" suffix covers both of the module's lines.
+const keepDirective = "fixtestsum:keep"
+
+// parseKeep returns the module versions named by keep directives in an
+// archive comment. A version is empty if the directive didn't have one.
+func parseKeep(comment []byte) []module.Version {
+	var keep []module.Version
+	for _, line := range strings.Split(string(comment), "\n") {
+		i := strings.Index(line, keepDirective)
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(line[i+len(keepDirective):])
+		switch len(fields) {
+		case 1:
+			keep = append(keep, module.Version{Path: fields[0]})
+		case 2:
+			keep = append(keep, module.Version{Path: fields[0], Version: fields[1]})
+		}
+	}
+	return keep
+}
+
+// isKept reports whether a go.sum line for m is covered by a keep directive.
+func isKept(keep []module.Version, m module.Version) bool {
+	for _, k := range keep {
+		if k.Path == m.Path && (k.Version == "" || k.Version == m.Version || k.Version+"/go.mod" == m.Version) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSumLine returns the module version a go.sum line is for. ok is false
+// if the line isn't a checksum line.
+func parseSumLine(line string) (m module.Version, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return module.Version{}, false
+	}
+	return module.Version{Path: fields[0], Version: fields[1]}, true
+}
+
+// sumLess reports whether the go.sum line for a sorts before the line for b,
+// in the order the go command writes them.
+func sumLess(a, b module.Version) bool {
+	if a.Path != b.Path {
+		return a.Path < b.Path
+	}
+	va, fa := a.Version, ""
+	if i := strings.Index(va, "/"); i >= 0 {
+		va, fa = va[:i], va[i:]
+	}
+	vb, fb := b.Version, ""
+	if i := strings.Index(vb, "/"); i >= 0 {
+		vb, fb = vb[:i], vb[i:]
+	}
+	if va != vb {
+		return semver.Compare(va, vb) < 0
+	}
+	return fa < fb
+}
+
+// mergeSum updates oldData, the content of a sum file in an archive, to
+// agree with newData, the sum file the go command wrote, while changing as
+// few lines as possible. Lines the go command didn't write are removed,
+// lines with different hashes are replaced in place, and missing lines are
+// inserted in sorted position. Lines that aren't checksums and lines
+// covered by keep are left alone.
+//
+// mergeSum returns the merged content and a description of each changed
+// line: the line prefixed with "-" if it was removed or "+" if it was added.
+func mergeSum(oldData, newData []byte, keep []module.Version) (merged []byte, changes []string) {
+	want := make(map[module.Version]string)
+	for _, line := range splitSumLines(newData) {
+		if m, ok := parseSumLine(line); ok {
+			want[m] = line
+		}
+	}
+
+	var lines []string
+	have := make(map[module.Version]bool)
+	for _, line := range splitSumLines(oldData) {
+		m, ok := parseSumLine(line)
+		if !ok || isKept(keep, m) {
+			lines = append(lines, line)
+			have[m] = true
+			continue
+		}
+		wantLine, ok := want[m]
+		if !ok || have[m] {
+			changes = append(changes, "-"+line)
+			continue
+		}
+		if wantLine != line {
+			changes = append(changes, "-"+line, "+"+wantLine)
+		}
+		lines = append(lines, wantLine)
+		have[m] = true
+	}
+
+	var missing []module.Version
+	for m := range want {
+		if !have[m] {
+			missing = append(missing, m)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return sumLess(missing[i], missing[j]) })
+	for _, m := range missing {
+		// Insert before the first checksum line that sorts after m, or after
+		// the last checksum line if there is none.
+		at := len(lines)
+		for i := len(lines) - 1; i >= 0; i-- {
+			other, ok := parseSumLine(lines[i])
+			if !ok {
+				continue
+			}
+			if !sumLess(m, other) {
+				break
+			}
+			at = i
+		}
+		if at == len(lines) {
+			for at > 0 {
+				if _, ok := parseSumLine(lines[at-1]); ok {
+					break
+				}
+				at--
+			}
+			if at == 0 {
+				at = len(lines)
+			}
+		}
+		lines = append(lines[:at], append([]string{want[m]}, lines[at:]...)...)
+		changes = append(changes, "+"+want[m])
+	}
+
+	if len(lines) == 0 {
+		return nil, changes
+	}
+	return []byte(strings.Join(lines, "\n") + "\n"), changes
+}
+
+func splitSumLines(data []byte) []string {
+	s := strings.TrimSuffix(string(data), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/module"
+)
+
+func TestParseKeep(t *testing.T) {
+	comment := `Tests that a wrong hash is reported.
+# fixtestsum:keep example.com/a v1.0.0
+#fixtestsum:keep example.com/b
+# fixtestsum:keep
+go build
+`
+	want := []module.Version{
+		{Path: "example.com/a", Version: "v1.0.0"},
+		{Path: "example.com/b"},
+	}
+	if got := parseKeep([]byte(comment)); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestMergeSum(t *testing.T) {
+	for _, tt := range []struct {
+		desc        string
+		old, new    string
+		keep        []module.Version
+		want        string
+		wantChanges []string
+	}{
+		{
+			desc: "unchanged",
+			old:  "a v1.0.0 h1:aa=\na v1.0.0/go.mod h1:am=\n",
+			new:  "a v1.0.0 h1:aa=\na v1.0.0/go.mod h1:am=\n",
+			want: "a v1.0.0 h1:aa=\na v1.0.0/go.mod h1:am=\n",
+		},
+		{
+			desc: "new_file",
+			new:  "a v1.0.0 h1:aa=\na v1.0.0/go.mod h1:am=\n",
+			want: "a v1.0.0 h1:aa=\na v1.0.0/go.mod h1:am=\n",
+			wantChanges: []string{
+				"+a v1.0.0 h1:aa=",
+				"+a v1.0.0/go.mod h1:am=",
+			},
+		},
+		{
+			desc: "kept_wrong_hash",
+			old:  "a v1.0.0 h1:WRONG=\na v1.0.0/go.mod h1:am=\nb v1.0.0/go.mod h1:UNUSED=\n",
+			new:  "a v1.0.0 h1:aa=\na v1.0.0/go.mod h1:am=\n",
+			keep: []module.Version{{Path: "a", Version: "v1.0.0"}, {Path: "b"}},
+			want: "a v1.0.0 h1:WRONG=\na v1.0.0/go.mod h1:am=\nb v1.0.0/go.mod h1:UNUSED=\n",
+		},
+		{
+			desc: "kept_go_mod_only",
+			old:  "a v1.0.0 h1:WRONG=\na v1.0.0/go.mod h1:WRONG=\n",
+			new:  "a v1.0.0 h1:aa=\na v1.0.0/go.mod h1:am=\n",
+			keep: []module.Version{{Path: "a", Version: "v1.0.0/go.mod"}},
+			want: "a v1.0.0 h1:aa=\na v1.0.0/go.mod h1:WRONG=\n",
+			wantChanges: []string{
+				"-a v1.0.0 h1:WRONG=",
+				"+a v1.0.0 h1:aa=",
+			},
+		},
+		{
+			desc: "replaced_hash",
+			old:  "a v1.0.0 h1:WRONG=\na v1.0.0/go.mod h1:am=\n",
+			new:  "a v1.0.0 h1:aa=\na v1.0.0/go.mod h1:am=\n",
+			want: "a v1.0.0 h1:aa=\na v1.0.0/go.mod h1:am=\n",
+			wantChanges: []string{
+				"-a v1.0.0 h1:WRONG=",
+				"+a v1.0.0 h1:aa=",
+			},
+		},
+		{
+			desc: "inserted_go_mod",
+			old:  "a v1.0.0 h1:aa=\nc v1.0.0 h1:cc=\n",
+			new:  "a v1.0.0 h1:aa=\na v1.0.0/go.mod h1:am=\nb v1.0.0/go.mod h1:bm=\nc v1.0.0 h1:cc=\n",
+			want: "a v1.0.0 h1:aa=\na v1.0.0/go.mod h1:am=\nb v1.0.0/go.mod h1:bm=\nc v1.0.0 h1:cc=\n",
+			wantChanges: []string{
+				"+a v1.0.0/go.mod h1:am=",
+				"+b v1.0.0/go.mod h1:bm=",
+			},
+		},
+		{
+			desc: "inserted_semver_order",
+			old:  "a v1.10.0 h1:a10=\n",
+			new:  "a v1.2.0/go.mod h1:a2m=\na v1.10.0 h1:a10=\n",
+			want: "a v1.2.0/go.mod h1:a2m=\na v1.10.0 h1:a10=\n",
+			wantChanges: []string{
+				"+a v1.2.0/go.mod h1:a2m=",
+			},
+		},
+		{
+			desc: "removed",
+			old:  "a v1.0.0 h1:aa=\nd v1.0.0 h1:dd=\nd v1.0.0 h1:dd=\ne v1.0.0 h1:ee=\n",
+			new:  "a v1.0.0 h1:aa=\ne v1.0.0 h1:ee=\n",
+			want: "a v1.0.0 h1:aa=\ne v1.0.0 h1:ee=\n",
+			wantChanges: []string{
+				"-d v1.0.0 h1:dd=",
+				"-d v1.0.0 h1:dd=",
+			},
+		},
+		{
+			desc: "removed_all",
+			old:  "d v1.0.0 h1:dd=\n",
+			want: "",
+			wantChanges: []string{
+				"-d v1.0.0 h1:dd=",
+			},
+		},
+		{
+			desc: "trailing_non_checksum_lines",
+			old:  "a v1.0.0 h1:aa=\n\n# not a checksum\n",
+			new:  "a v1.0.0 h1:aa=\nb v1.0.0 h1:bb=\n",
+			want: "a v1.0.0 h1:aa=\nb v1.0.0 h1:bb=\n\n# not a checksum\n",
+			wantChanges: []string{
+				"+b v1.0.0 h1:bb=",
+			},
+		},
+		{
+			desc: "only_non_checksum_lines",
+			old:  "# not a checksum\n",
+			new:  "a v1.0.0 h1:aa=\n",
+			want: "# not a checksum\na v1.0.0 h1:aa=\n",
+			wantChanges: []string{
+				"+a v1.0.0 h1:aa=",
+			},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, changes := mergeSum([]byte(tt.old), []byte(tt.new), tt.keep)
+			if string(got) != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+			if strings.Join(changes, "\n") != strings.Join(tt.wantChanges, "\n") {
+				t.Errorf("got changes:\n%s\nwant:\n%s", strings.Join(changes, "\n"), strings.Join(tt.wantChanges, "\n"))
+			}
+		})
+	}
+}
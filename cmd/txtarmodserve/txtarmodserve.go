@@ -1,21 +1,23 @@
 package main
 
 import (
-	"archive/zip"
-	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
-	"golang.org/x/mod/module"
-	"golang.org/x/mod/semver"
-	"golang.org/x/tools/txtar"
+	"github.com/jayconrod/misc/internal/atomicfile"
+	"github.com/jayconrod/misc/txtarproxy"
 )
 
 func main() {
@@ -26,205 +28,269 @@ func main() {
 }
 
 func run(args []string) error {
-	var httpAddr, dir string
+	var httpAddr, dir, upstream, certFile, accessLog, addrFile, exportDir string
+	var record, useTLS, lax, check, reload bool
+	var bundlePaths, basicAuths, bearerAuths stringList
 	flags := flag.NewFlagSet("txtarmodserve", flag.ContinueOnError)
-	flags.StringVar(&httpAddr, "http", "localhost:6939", "HTTP address and port to listen to")
+	flags.StringVar(&httpAddr, "http", "localhost:6939", "HTTP address and port to listen to (port 0 picks an unused port), or unix:path for a Unix socket")
+	flags.StringVar(&addrFile, "addrfile", "", "file to write the listening address to once the server is ready")
+	flags.BoolVar(&reload, "reload", false, "re-index bundles when files in dir change")
 	flags.StringVar(&dir, "dir", ".", "directory to serve txtar archives from")
+	flags.Var(&bundlePaths, "bundle", "multi-module txtar archive in dir to serve (may be repeated)")
+	flags.StringVar(&upstream, "upstream", "", "GOPROXY URL (http, https, or file) to forward requests to when a module is not found in dir")
+	flags.BoolVar(&record, "record", false, "save modules fetched from -upstream as txtar archives in dir")
+	flags.BoolVar(&useTLS, "tls", false, "serve HTTPS with an automatically generated self-signed certificate")
+	flags.StringVar(&certFile, "certfile", "", "file to write the -tls certificate to, for use as SSL_CERT_FILE (default: a file in a new temporary directory, removed on exit)")
+	flags.BoolVar(&lax, "lax", false, "serve modules with inconsistent go.mod files or versions, logging warnings instead of reporting errors")
+	flags.BoolVar(&check, "check", false, "validate all modules in dir and bundles, then exit without serving")
+	flags.StringVar(&exportDir, "export", "", "write all modules as a static GOPROXY tree in this directory, then exit without serving")
+	flags.StringVar(&accessLog, "accesslog", "", "file to write a JSON access log to, or - for stderr")
+	flags.Var(&basicAuths, "basicauth", "require HTTP basic auth for matching modules, as pattern=user:password (may be repeated)")
+	flags.Var(&bearerAuths, "bearer", "require a bearer token for matching modules, as pattern=token (may be repeated)")
 	if err := flags.Parse(args); err != nil {
 		return err
 	}
-	fmt.Fprintf(os.Stderr, "serving on %s\n", httpAddr)
-	return http.ListenAndServe(httpAddr, server{dir: dir})
-}
-
-type server struct {
-	dir string
-}
-
-func (s server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if req.Method != http.MethodGet && req.Method != http.MethodHead {
-		writeStatus(w, http.StatusBadRequest)
-		return
+	if record && upstream == "" {
+		return errors.New("-record requires -upstream")
 	}
 
-	modPath, version, ext, err := parsePath(req.URL.Path)
-	if err != nil {
-		writeError(w, http.StatusNotFound, err)
-		return
-	}
-
-	var contentType string
-	var data []byte
-	switch ext {
-	case "latest":
-		writeStatus(w, http.StatusNotFound)
-		return
-	case "list":
-		contentType = "text/plain"
-		data, err = s.list(modPath)
-	case "info":
-		contentType = "application/json"
-		data, err = s.info(modPath, version)
-	case "mod":
-		contentType = "text/plain"
-		data, err = s.mod(modPath, version)
-	case "zip":
-		contentType = "application/zip"
-		data, err = s.zip(modPath, version)
-	default:
-		panic("unreachable")
-	}
-
-	if err != nil {
-		writeError(w, http.StatusNotFound, err)
-		return
+	bundles := make([]string, 0, len(bundlePaths))
+	for _, p := range bundlePaths {
+		name, err := relToDir(dir, p)
+		if err != nil {
+			return err
+		}
+		bundles = append(bundles, name)
 	}
-	w.Header().Add("Content-Type", contentType)
-	w.Write(data)
-}
-
-func (s server) list(modPath string) ([]byte, error) {
-	f, err := os.OpenFile(s.dir, os.O_RDONLY, 0)
+	s, err := txtarproxy.NewServer(os.DirFS(dir), bundles...)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer f.Close()
-	names, err := f.Readdirnames(0)
-	if err != nil {
-		return nil, err
+	if check {
+		errs := s.Check()
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("found %d invalid module versions", len(errs))
+		}
+		return nil
 	}
-	buf := &bytes.Buffer{}
-	prefix := strings.ReplaceAll(modPath, "/", "_") + "_"
-	suffix := ".txt"
-	for _, name := range names {
-		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
-			continue
+	if exportDir != "" {
+		s.Lax = lax
+		if err := s.Export(exportDir); err != nil {
+			return err
 		}
-		v := name[len(prefix) : len(name)-len(suffix)]
-		if c := semver.Canonical(v); v == "" || c != v {
-			continue
+		abs, err := filepath.Abs(filepath.Join(exportDir, "cache", "download"))
+		if err != nil {
+			return err
 		}
-		buf.WriteString(v)
-		buf.WriteString("\n")
+		fmt.Fprintf(os.Stderr, "exported modules; use GOPROXY=file://%s\n", filepath.ToSlash(abs))
+		return nil
 	}
-	return buf.Bytes(), nil
-}
-
-func (s server) info(modPath, version string) ([]byte, error) {
-	fi, err := os.Stat(s.fileName(modPath, version))
-	if err != nil {
-		return nil, err
+	s.Upstream = upstream
+	s.Lax = lax
+	if record {
+		s.RecordDir = dir
 	}
-	info := struct {
-		Version string
-		Time    string
-	}{
-		version,
-		fi.ModTime().UTC().Format(time.RFC3339),
+	for _, arg := range basicAuths {
+		pattern, cred, ok := cut(arg, "=")
+		user, password, ok2 := cut(cred, ":")
+		if !ok || !ok2 || pattern == "" || user == "" {
+			return fmt.Errorf("-basicauth %q: want pattern=user:password", arg)
+		}
+		s.Auth = append(s.Auth, txtarproxy.AuthRule{Pattern: pattern, User: user, Password: password})
 	}
-	return json.Marshal(info)
-}
-
-func (s server) mod(modPath, version string) ([]byte, error) {
-	arc, err := txtar.ParseFile(s.fileName(modPath, version))
-	if err != nil {
-		return nil, err
+	for _, arg := range bearerAuths {
+		pattern, token, ok := cut(arg, "=")
+		if !ok || pattern == "" || token == "" {
+			return fmt.Errorf("-bearer %q: want pattern=token", arg)
+		}
+		s.Auth = append(s.Auth, txtarproxy.AuthRule{Pattern: pattern, Token: token})
 	}
-	for _, f := range arc.Files {
-		if f.Name == "go.mod" {
-			return f.Data, nil
+
+	switch accessLog {
+	case "":
+	case "-":
+		s.AccessLog = os.Stderr
+	default:
+		f, err := os.OpenFile(accessLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return err
 		}
+		defer f.Close()
+		s.AccessLog = f
 	}
-	return []byte(fmt.Sprintf("module %s", modPath)), nil
-}
 
-func (s server) zip(modPath, version string) ([]byte, error) {
-	arc, err := txtar.ParseFile(s.fileName(modPath, version))
+	ln, err := listen(httpAddr)
 	if err != nil {
-		return nil, err
-	}
-	buf := &bytes.Buffer{}
-	z := zip.NewWriter(buf)
-	prefix := fmt.Sprintf("%s@%s/", modPath, version)
-	for _, f := range arc.Files {
-		name := prefix + f.Name
-		w, err := z.Create(name)
+		return err
+	}
+	defer ln.Close()
+
+	srv := &http.Server{Handler: s}
+	scheme := "http"
+	if useTLS {
+		hosts := []string{"localhost", "127.0.0.1", "::1"}
+		if host, _, err := net.SplitHostPort(httpAddr); err == nil && host != "" {
+			hosts = append(hosts, host)
+		}
+		cert, certPEM, err := txtarproxy.SelfSignedCert(hosts...)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if certFile == "" {
+			// Use a new directory rather than a fixed path, so that servers
+			// running in parallel don't overwrite each other's certificates.
+			certDir, err := ioutil.TempDir("", "txtarmodserve")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(certDir)
+			certFile = filepath.Join(certDir, "cert.pem")
 		}
-		if _, err = w.Write(f.Data); err != nil {
-			return nil, err
+		// Write with a rename, so a symlink at certFile is replaced rather
+		// than followed.
+		if err := atomicfile.WriteFile(certFile, certPEM); err != nil {
+			return err
 		}
+		fmt.Fprintf(os.Stderr, "wrote certificate to %s\n", certFile)
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		ln = tls.NewListener(ln, srv.TLSConfig)
+		scheme = "https"
 	}
-	if err := z.Close(); err != nil {
-		return nil, err
+
+	addr := ln.Addr().String()
+	if ln.Addr().Network() == "unix" {
+		addr = "unix:" + addr
+	}
+	if addrFile != "" {
+		if err := atomicfile.WriteFile(addrFile, []byte(addr+"\n")); err != nil {
+			return err
+		}
+	}
+	if reload {
+		stop := make(chan struct{})
+		defer close(stop)
+		go watch(dir, s, stop)
 	}
-	return buf.Bytes(), nil
-}
 
-func (s server) fileName(modPath, version string) string {
-	name := strings.ReplaceAll(modPath, "/", "_")
-	return filepath.Join(s.dir, name+"_"+version+".txt")
-}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(ln) }()
+	fmt.Fprintf(os.Stderr, "serving on %s://%s\n", scheme, addr)
 
-func parsePath(path string) (modPath, version, ext string, err error) {
-	defer func() {
-		if err != nil {
-			err = fmt.Errorf("parsing path %s: %w", path, err)
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-sigc:
+		fmt.Fprintf(os.Stderr, "received %v; shutting down\n", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			return err
 		}
-	}()
-
-	if !strings.HasPrefix(path, "/") {
-		return "", "", "", errors.New("does not start with '/'")
+		if err := <-errc; err != http.ErrServerClosed {
+			return err
+		}
+		return nil
 	}
-	rest := path[1:]
-	if strings.HasSuffix(rest, "/@latest") {
-		modPath = rest[:len(rest)-len("/@latest")]
-		ext = "latest"
-	} else if strings.HasSuffix(rest, "/@v/list") {
-		modPath = rest[:len(rest)-len("/@v/list")]
-		ext = "list"
-	} else {
-		at := strings.Index(rest, "/@v/")
-		if at < 0 {
-			return "", "", "", errors.New("does not contain '@'")
+}
+
+// listen opens a listener for the -http flag. addr may be a TCP address
+// like "localhost:6939" or ":0" to pick an unused port, or a Unix socket path
+// prefixed with "unix:". A stale socket file at the path is removed first.
+func listen(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
 		}
-		modPath = rest[:at]
-		rest = rest[at+len("/@v/"):]
-		dot := strings.LastIndex(rest, ".")
-		if dot < 0 {
-			return "", "", "", errors.New("does not have extension")
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// watch polls dir for changes once per second and reloads s when any file is
+// added, removed, or modified. watch returns when stop is closed.
+func watch(dir string, s *txtarproxy.Server, stop <-chan struct{}) {
+	last, _ := fingerprint(dir)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
 		}
-		version = rest[:dot]
-		ext = rest[dot+1:]
-		if version, err = module.UnescapeVersion(version); err != nil {
-			return "", "", "", err
+		fp, err := fingerprint(dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "watching %s: %v\n", dir, err)
+			continue
 		}
-		if version == "" {
-			return "", "", "", errors.New("version is empty")
+		if fp == last {
+			continue
 		}
-		if c := semver.Canonical(version); c != version {
-			return "", "", "", fmt.Errorf("version %q is not canonical", version)
+		last = fp
+		if err := s.Reload(); err != nil {
+			fmt.Fprintf(os.Stderr, "reloading: %v\n", err)
+		} else {
+			fmt.Fprintf(os.Stderr, "reloaded %s\n", dir)
 		}
 	}
+}
 
-	if modPath, err = module.UnescapePath(modPath); err != nil {
-		return "", "", "", err
+// fingerprint returns a string summarizing the names, sizes, and
+// modification times of files in dir.
+func fingerprint(dir string) (string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
 	}
-	switch ext {
-	case "info", "latest", "list", "mod", "zip":
-	default:
-		return "", "", "", fmt.Errorf("invalid extension %q", ext)
+	b := &strings.Builder{}
+	for _, fi := range fis {
+		fmt.Fprintf(b, "%s %d %d\n", fi.Name(), fi.Size(), fi.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+// cut slices s around the first instance of sep.
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
 	}
-	return modPath, version, ext, nil
+	return s, "", false
 }
 
-func writeError(w http.ResponseWriter, code int, err error) {
-	w.WriteHeader(code)
-	fmt.Fprintf(w, "%s: %v", http.StatusText(code), err)
+// relToDir converts a file path to a slash-separated path relative to dir,
+// suitable for opening with os.DirFS(dir).
+func relToDir(dir, path string) (string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not in directory %s", path, dir)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// stringList is a flag.Value that accumulates strings from a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
 }
 
-func writeStatus(w http.ResponseWriter, code int) {
-	w.WriteHeader(code)
-	fmt.Fprint(w, http.StatusText(code))
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
 }
@@ -1,6 +1,6 @@
 module github.com/jayconrod/misc
 
-go 1.14
+go 1.16
 
 require (
 	github.com/bazelbuild/buildtools v0.0.0-20200206174301-b0fd03a9fe40
@@ -0,0 +1,233 @@
+// Package diff computes line-oriented differences between texts, formats
+// them as unified diffs, and merges changes made to a common base.
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// context is the number of unchanged lines shown around each change.
+const context = 3
+
+// Unified returns a unified diff of old and new, labeled with oldName and
+// newName. If old and new are equal, Unified returns nil.
+func Unified(oldName, newName string, old, new []byte) []byte {
+	if bytes.Equal(old, new) {
+		return nil
+	}
+	a, b := splitLines(old), splitLines(new)
+	edits := lineEdits(a, b)
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "--- %s\n+++ %s\n", oldName, newName)
+	for i := 0; i < len(edits); {
+		// Find the next change, then extend the hunk until there are more
+		// than 2*context unchanged lines before the following change.
+		for i < len(edits) && edits[i].op == ' ' {
+			i++
+		}
+		if i == len(edits) {
+			break
+		}
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(edits); j++ {
+			if edits[j].op != ' ' {
+				end = j + 1
+			} else if j-end >= 2*context {
+				break
+			}
+		}
+		stop := end + context
+		if stop > len(edits) {
+			stop = len(edits)
+		}
+		writeHunk(buf, edits[start:stop])
+		i = stop
+	}
+	return buf.Bytes()
+}
+
+// An edit is a line in a diff. op is ' ' for a line present in both texts,
+// '-' for a line only in the old text, or '+' for a line only in the new
+// text. aLine and bLine are the 0-based indices of the line in the old and
+// new texts, or of the next line in that text for insertions and deletions.
+type edit struct {
+	op           byte
+	line         string
+	aLine, bLine int
+}
+
+func writeHunk(buf *bytes.Buffer, edits []edit) {
+	aCount, bCount := 0, 0
+	for _, e := range edits {
+		if e.op != '+' {
+			aCount++
+		}
+		if e.op != '-' {
+			bCount++
+		}
+	}
+	aStart, bStart := edits[0].aLine+1, edits[0].bLine+1
+	if aCount == 0 {
+		aStart--
+	}
+	if bCount == 0 {
+		bStart--
+	}
+	fmt.Fprintf(buf, "@@ -%s +%s @@\n", hunkRange(aStart, aCount), hunkRange(bStart, bCount))
+	for _, e := range edits {
+		buf.WriteByte(e.op)
+		buf.WriteString(e.line)
+		if !strings.HasSuffix(e.line, "\n") {
+			buf.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// Merge3 merges the changes made from base to a and from base to b. Lines
+// changed in only one of a and b take that version; lines changed the same
+// way in both are kept once. If a and b change the same lines differently,
+// Merge3 returns false.
+func Merge3(base, a, b []byte) (merged []byte, ok bool) {
+	baseLines, aLines, bLines := splitLines(base), splitLines(a), splitLines(b)
+	aMatch := matchLines(baseLines, aLines)
+	bMatch := matchLines(baseLines, bLines)
+
+	buf := &bytes.Buffer{}
+	i, j, k := 0, 0, 0
+	for {
+		// Copy lines unchanged in both a and b.
+		for i < len(baseLines) && aMatch[i] == j && bMatch[i] == k {
+			buf.WriteString(baseLines[i])
+			i++
+			j++
+			k++
+		}
+		if i == len(baseLines) && j == len(aLines) && k == len(bLines) {
+			return buf.Bytes(), true
+		}
+
+		// Find the next base line present in both a and b. Everything before
+		// it is a changed chunk.
+		ni, nj, nk := i, len(aLines), len(bLines)
+		for ; ni < len(baseLines); ni++ {
+			if aMatch[ni] >= 0 && bMatch[ni] >= 0 {
+				nj, nk = aMatch[ni], bMatch[ni]
+				break
+			}
+		}
+		baseChunk, aChunk, bChunk := baseLines[i:ni], aLines[j:nj], bLines[k:nk]
+		switch {
+		case equalLines(aChunk, baseChunk) || equalLines(aChunk, bChunk):
+			writeLines(buf, bChunk)
+		case equalLines(bChunk, baseChunk):
+			writeLines(buf, aChunk)
+		default:
+			return nil, false
+		}
+		i, j, k = ni, nj, nk
+	}
+}
+
+// matchLines returns, for each line in a, the index of the matching line in
+// b in a longest common subsequence, or -1 if the line has no match.
+func matchLines(a, b []string) []int {
+	match := make([]int, len(a))
+	for i := range match {
+		match[i] = -1
+	}
+	for _, e := range lineEdits(a, b) {
+		if e.op == ' ' {
+			match[e.aLine] = e.bLine
+		}
+	}
+	return match
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func writeLines(buf *bytes.Buffer, lines []string) {
+	for _, line := range lines {
+		buf.WriteString(line)
+	}
+}
+
+// lineEdits returns a minimal sequence of edits transforming a into b,
+// computed from the longest common subsequence of lines.
+func lineEdits(a, b []string) []edit {
+	// lcs[i][j] is the length of the longest common subsequence of
+	// a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var edits []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i], i, j})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', a[i], i, j})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j], i, j})
+			j++
+		}
+	}
+	return edits
+}
+
+// splitLines splits data into lines, each including its trailing newline.
+// The last line has no newline if data doesn't end with one.
+func splitLines(data []byte) []string {
+	var lines []string
+	s := string(data)
+	for s != "" {
+		i := strings.IndexByte(s, '\n')
+		if i < 0 {
+			lines = append(lines, s)
+			break
+		}
+		lines = append(lines, s[:i+1])
+		s = s[i+1:]
+	}
+	return lines
+}
@@ -0,0 +1,154 @@
+package diff
+
+import "testing"
+
+func TestUnified(t *testing.T) {
+	for _, test := range []struct {
+		desc, old, new, want string
+	}{
+		{
+			desc: "equal",
+			old:  "a\nb\n",
+			new:  "a\nb\n",
+			want: "",
+		}, {
+			desc: "change",
+			old:  "a\nb\nc\n",
+			new:  "a\nB\nc\n",
+			want: `--- old
++++ new
+@@ -1,3 +1,3 @@
+ a
+-b
++B
+ c
+`,
+		}, {
+			desc: "insert_into_empty",
+			old:  "",
+			new:  "a\n",
+			want: `--- old
++++ new
+@@ -0,0 +1 @@
++a
+`,
+		}, {
+			desc: "separate_hunks",
+			old:  "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n",
+			new:  "0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			want: `--- old
++++ new
+@@ -1,3 +1,4 @@
++0
+ 1
+ 2
+ 3
+@@ -7,4 +8,3 @@
+ 7
+ 8
+ 9
+-10
+`,
+		}, {
+			desc: "merged_hunks",
+			old:  "1\n2\n3\n4\n5\n",
+			new:  "1\nx\n3\n4\ny\n",
+			want: `--- old
++++ new
+@@ -1,5 +1,5 @@
+ 1
+-2
++x
+ 3
+ 4
+-5
++y
+`,
+		}, {
+			desc: "no_final_newline",
+			old:  "a\nb",
+			new:  "a\nb\n",
+			want: `--- old
++++ new
+@@ -1,2 +1,2 @@
+ a
+-b
+\ No newline at end of file
++b
+`,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			got := string(Unified("old", "new", []byte(test.old), []byte(test.new)))
+			if got != test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMerge3(t *testing.T) {
+	for _, test := range []struct {
+		desc, base, a, b, want string
+		wantOK                 bool
+	}{
+		{
+			desc:   "unchanged",
+			base:   "1\n2\n3\n",
+			a:      "1\n2\n3\n",
+			b:      "1\n2\n3\n",
+			want:   "1\n2\n3\n",
+			wantOK: true,
+		}, {
+			desc:   "only_a",
+			base:   "1\n2\n3\n",
+			a:      "1\nx\n3\n",
+			b:      "1\n2\n3\n",
+			want:   "1\nx\n3\n",
+			wantOK: true,
+		}, {
+			desc:   "only_b",
+			base:   "1\n2\n3\n",
+			a:      "1\n2\n3\n",
+			b:      "0\n1\n2\n3\n4\n",
+			want:   "0\n1\n2\n3\n4\n",
+			wantOK: true,
+		}, {
+			desc:   "separate",
+			base:   "1\n2\n3\n4\n5\n",
+			a:      "1\nx\n3\n4\n5\n",
+			b:      "1\n2\n3\n5\ny\n",
+			want:   "1\nx\n3\n5\ny\n",
+			wantOK: true,
+		}, {
+			desc:   "same_change",
+			base:   "1\n2\n3\n",
+			a:      "1\nx\n3\n",
+			b:      "1\nx\n3\n",
+			want:   "1\nx\n3\n",
+			wantOK: true,
+		}, {
+			desc:   "conflict",
+			base:   "1\n2\n3\n",
+			a:      "1\nx\n3\n",
+			b:      "1\ny\n3\n",
+			wantOK: false,
+		}, {
+			desc:   "conflicting_inserts",
+			base:   "1\n",
+			a:      "1\nx\n",
+			b:      "1\ny\n",
+			wantOK: false,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			got, ok := Merge3([]byte(test.base), []byte(test.a), []byte(test.b))
+			if ok != test.wantOK {
+				t.Fatalf("got ok %v; want %v", ok, test.wantOK)
+			}
+			if ok && string(got) != test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
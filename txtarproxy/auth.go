@@ -0,0 +1,89 @@
+package txtarproxy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// An AuthRule requires clients to authenticate when requesting modules
+// matching Pattern. This can be used to mimic a private proxy, for example,
+// to test GOPRIVATE, GOAUTH, or .netrc configuration.
+type AuthRule struct {
+	// Pattern is a comma-separated list of glob patterns of module path
+	// prefixes, in the same format as GOPRIVATE.
+	Pattern string
+
+	// User and Password are accepted as HTTP basic auth credentials if
+	// User is not empty.
+	User, Password string
+
+	// Token is accepted as a bearer token in the Authorization header if
+	// it's not empty.
+	Token string
+}
+
+// authStatus checks whether req is authorized to access modPath according
+// to s.Auth. If no rule matches modPath, any request is authorized.
+// If a rule matches, req must contain credentials accepted by one of the
+// matching rules. authStatus returns http.StatusOK if req is authorized,
+// http.StatusUnauthorized if it has no credentials, or http.StatusForbidden
+// if its credentials are not accepted.
+func (s *Server) authStatus(req *http.Request, modPath string) int {
+	var matched []AuthRule
+	for _, rule := range s.Auth {
+		if module.MatchPrefixPatterns(rule.Pattern, modPath) {
+			matched = append(matched, rule)
+		}
+	}
+	if len(matched) == 0 {
+		return http.StatusOK
+	}
+	if req.Header.Get("Authorization") == "" {
+		return http.StatusUnauthorized
+	}
+
+	user, password, hasBasic := req.BasicAuth()
+	token := ""
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	for _, rule := range matched {
+		if rule.User != "" && hasBasic && equal(rule.User, user) && equal(rule.Password, password) {
+			return http.StatusOK
+		}
+		if rule.Token != "" && token != "" && equal(rule.Token, token) {
+			return http.StatusOK
+		}
+	}
+	return http.StatusForbidden
+}
+
+// writeAuthError writes a 401 or 403 response like a private proxy would.
+// For 401 responses, a WWW-Authenticate header lists the schemes accepted by
+// the rules matching modPath.
+func (s *Server) writeAuthError(w http.ResponseWriter, code int, modPath string) {
+	if code == http.StatusUnauthorized {
+		basic, bearer := false, false
+		for _, rule := range s.Auth {
+			if module.MatchPrefixPatterns(rule.Pattern, modPath) {
+				basic = basic || rule.User != ""
+				bearer = bearer || rule.Token != ""
+			}
+		}
+		if basic {
+			w.Header().Add("WWW-Authenticate", `Basic realm="txtarproxy"`)
+		}
+		if bearer {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="txtarproxy"`)
+		}
+	}
+	writeError(w, code, fmt.Errorf("access to %s denied", modPath))
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
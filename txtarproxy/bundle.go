@@ -0,0 +1,76 @@
+package txtarproxy
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/tools/txtar"
+)
+
+// loadBundles reads multi-module txtar archives from fsys and indexes the
+// module versions they contain. The returned archives contain file names
+// relative to each module's root directory.
+func loadBundles(fsys fs.FS, names []string) (map[module.Version]*txtar.Archive, error) {
+	bundle := make(map[module.Version]*txtar.Archive)
+	for _, name := range names {
+		if err := loadBundle(bundle, fsys, name); err != nil {
+			return nil, err
+		}
+	}
+	return bundle, nil
+}
+
+func loadBundle(bundle map[module.Version]*txtar.Archive, fsys fs.FS, name string) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("loading bundle %s: %w", name, err)
+		}
+	}()
+
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return err
+	}
+	arc := txtar.Parse(data)
+	for _, f := range arc.Files {
+		mv, fileName, err := splitBundleName(f.Name)
+		if err != nil {
+			return err
+		}
+		modArc, ok := bundle[mv]
+		if !ok {
+			modArc = &txtar.Archive{}
+			bundle[mv] = modArc
+		}
+		modArc.Files = append(modArc.Files, txtar.File{Name: fileName, Data: f.Data})
+	}
+	return nil
+}
+
+// splitBundleName splits a bundle file name like
+// "example.com/a@v1.0.0/go.mod" into a module version and a file name
+// relative to the module root.
+func splitBundleName(bundleName string) (mv module.Version, name string, err error) {
+	at := strings.Index(bundleName, "@")
+	if at < 0 {
+		return module.Version{}, "", fmt.Errorf("file %q: name does not contain '@'", bundleName)
+	}
+	slash := strings.Index(bundleName[at:], "/")
+	if slash < 0 {
+		return module.Version{}, "", fmt.Errorf("file %q: name does not contain '/' after version", bundleName)
+	}
+	mv = module.Version{Path: bundleName[:at], Version: bundleName[at+1 : at+slash]}
+	name = bundleName[at+slash+1:]
+	if err := module.CheckPath(mv.Path); err != nil {
+		return module.Version{}, "", fmt.Errorf("file %q: %w", bundleName, err)
+	}
+	if !isCanonicalVersion(mv.Version) {
+		return module.Version{}, "", fmt.Errorf("file %q: version %q is not canonical", bundleName, mv.Version)
+	}
+	if name == "" {
+		return module.Version{}, "", fmt.Errorf("file %q: file name is empty", bundleName)
+	}
+	return mv, name, nil
+}
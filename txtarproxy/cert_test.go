@@ -0,0 +1,52 @@
+package txtarproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSelfSignedCert(t *testing.T) {
+	cert, certPEM, err := SelfSignedCert("localhost", "127.0.0.1", "::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(testFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(s)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	// Trust only the PEM-encoded certificate, as the go command would with
+	// SSL_CERT_FILE.
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(certPEM) {
+		t.Fatal("could not parse certificate PEM")
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	resp, err := client.Get(srv.URL + "/example.com/a/@v/list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "v1.0.0\nv1.1.0\n"; resp.StatusCode != http.StatusOK || got != want {
+		t.Errorf("got status %d, %q; want %d, %q", resp.StatusCode, got, http.StatusOK, want)
+	}
+
+	// A client that doesn't trust the certificate can't connect.
+	untrusted := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: x509.NewCertPool()}}}
+	if resp, err := untrusted.Get(srv.URL + "/example.com/a/@v/list"); err == nil {
+		resp.Body.Close()
+		t.Error("request with untrusted certificate succeeded")
+	}
+}
@@ -0,0 +1,104 @@
+package txtarproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/tools/txtar"
+)
+
+// checkArchive reports whether arc is a valid module version for the given
+// module path and version. It checks that the version is consistent with
+// the path's major version suffix, that the module path declared in .mod or
+// go.mod matches, that any .info file describes the right version, and that
+// zip file names are valid.
+func checkArchive(arc *txtar.Archive, modPath, version string) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("%s@%s: %w", modPath, version, err)
+		}
+	}()
+
+	if err := module.Check(modPath, version); err != nil {
+		return err
+	}
+
+	modName := ".mod"
+	modData, ok := findFile(arc, modName)
+	if !ok {
+		modName = "go.mod"
+		modData, ok = findFile(arc, modName)
+	}
+	if ok {
+		declared := modfile.ModulePath(modData)
+		if declared == "" {
+			return fmt.Errorf("%s does not declare a module path", modName)
+		}
+		if declared != modPath {
+			return fmt.Errorf("%s declares module path %s, but was requested as %s", modName, declared, modPath)
+		}
+		if modName == "go.mod" && semver.Build(version) == "+incompatible" {
+			return fmt.Errorf("version is +incompatible, but module has a go.mod file")
+		}
+	}
+
+	if infoData, ok := findFile(arc, ".info"); ok {
+		var rev revInfo
+		if err := json.Unmarshal(infoData, &rev); err != nil {
+			return fmt.Errorf(".info: %w", err)
+		}
+		if rev.Version != version {
+			return fmt.Errorf(".info has version %s", rev.Version)
+		}
+	}
+
+	seen := make(map[string]string)
+	for _, f := range zipFiles(arc) {
+		if err := module.CheckFilePath(f.Name); err != nil {
+			return err
+		}
+		folded := strings.ToLower(f.Name)
+		if other, ok := seen[folded]; ok && other == f.Name {
+			return fmt.Errorf("duplicate file %s", f.Name)
+		} else if ok {
+			return fmt.Errorf("files %s and %s have the same name when case is ignored", other, f.Name)
+		}
+		seen[folded] = f.Name
+	}
+	return nil
+}
+
+// Check validates every module version the server has in its archives and
+// bundles, as checkArchive would when serving them. It returns a list of
+// problems found, which is empty if all modules are valid. Check does not
+// contact Upstream.
+func (s *Server) Check() []error {
+	mvs, err := s.moduleVersions()
+	if err != nil {
+		return []error{err}
+	}
+	var errs []error
+	for _, mv := range mvs {
+		arc, err := s.archive(mv.Path, mv.Version)
+		if err == nil {
+			err = checkArchive(arc, mv.Path, mv.Version)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,61 @@
+package txtarproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// Export writes every module version the server has to dir as a static
+// module proxy tree: dir/cache/download/<module>/@v/{list,<version>.info,
+// <version>.mod,<version>.zip}, with module paths and versions escaped.
+// The tree may be used without a server by setting
+// GOPROXY=file://<dir>/cache/download. Export does not contact Upstream.
+func (s *Server) Export(dir string) error {
+	mvs, err := s.moduleVersions()
+	if err != nil {
+		return err
+	}
+
+	lists := make(map[string]*strings.Builder)
+	for _, mv := range mvs {
+		escPath, err := module.EscapePath(mv.Path)
+		if err != nil {
+			return err
+		}
+		escVersion, err := module.EscapeVersion(mv.Version)
+		if err != nil {
+			return err
+		}
+		vDir := filepath.Join(dir, "cache", "download", filepath.FromSlash(escPath), "@v")
+		if err := os.MkdirAll(vDir, 0777); err != nil {
+			return err
+		}
+		for _, ext := range []string{"info", "mod", "zip"} {
+			data, err := s.get(mv.Path, mv.Version, ext)
+			if err != nil {
+				return fmt.Errorf("exporting %s@%s: %w", mv.Path, mv.Version, err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(vDir, escVersion+"."+ext), data, 0666); err != nil {
+				return err
+			}
+		}
+
+		if lists[vDir] == nil {
+			lists[vDir] = &strings.Builder{}
+		}
+		lists[vDir].WriteString(mv.Version)
+		lists[vDir].WriteString("\n")
+	}
+
+	for vDir, list := range lists {
+		if err := ioutil.WriteFile(filepath.Join(vDir, "list"), []byte(list.String()), 0666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package txtarproxy
+
+import (
+	"html/template"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/tools/txtar"
+)
+
+// moduleVersions returns every module version available from s.fsys and
+// s.bundle, sorted by module path, then by version. The module path of a
+// single-module archive is read from its .mod or go.mod file if it matches
+// the archive's name; otherwise, it's derived from the archive's name.
+func (s *Server) moduleVersions() ([]module.Version, error) {
+	seen := make(map[module.Version]bool)
+	var mvs []module.Version
+	for mv := range s.bundleIndex() {
+		seen[mv] = true
+		mvs = append(mvs, mv)
+	}
+
+	entries, err := fs.ReadDir(s.fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || s.bundleNames[name] || !strings.HasSuffix(name, ".txt") {
+			continue
+		}
+		base := strings.TrimSuffix(name, ".txt")
+		i := strings.LastIndex(base, "_")
+		if i < 0 {
+			continue
+		}
+		prefix, version := base[:i], base[i+1:]
+		if !isCanonicalVersion(version) {
+			continue
+		}
+		modPath := strings.ReplaceAll(prefix, "_", "/")
+		if data, err := fs.ReadFile(s.fsys, name); err == nil {
+			modData, _ := mod(txtar.Parse(data), modPath)
+			if declared := modfile.ModulePath(modData); declared != "" && fileName(declared, version) == name {
+				modPath = declared
+			}
+		}
+		mv := module.Version{Path: modPath, Version: version}
+		if !seen[mv] {
+			seen[mv] = true
+			mvs = append(mvs, mv)
+		}
+	}
+
+	sort.Slice(mvs, func(i, j int) bool {
+		if mvs[i].Path != mvs[j].Path {
+			return mvs[i].Path < mvs[j].Path
+		}
+		return semver.Compare(mvs[i].Version, mvs[j].Version) < 0
+	})
+	return mvs, nil
+}
+
+// indexModule is a module listed on the index page.
+type indexModule struct {
+	Path     string
+	Versions []indexVersion
+}
+
+// indexVersion is a module version listed on the index page.
+type indexVersion struct {
+	Version string
+	Info    string
+	Mod     string
+	Files   []string
+	Err     string
+
+	// URL is the escaped proxy URL path of the version, without an extension,
+	// like "/example.com/a/@v/v1.0.0".
+	URL string
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>txtarproxy</title>
+<style>
+body { font-family: sans-serif; }
+pre { background: #eee; padding: 0.5em; }
+</style>
+</head>
+<body>
+<h1>Modules</h1>
+<ul>
+{{range .}}<li><a href="#{{.Path}}">{{.Path}}</a></li>
+{{end}}</ul>
+{{range .}}
+<h2 id="{{.Path}}">{{.Path}}</h2>
+{{range .Versions}}
+<h3>{{.Version}}</h3>
+{{if .Err}}<p>error: {{.Err}}</p>{{else}}
+<p><a href="{{.URL}}.info">.info</a> <a href="{{.URL}}.mod">.mod</a> <a href="{{.URL}}.zip">.zip</a></p>
+<pre>{{.Info}}</pre>
+<pre>{{.Mod}}</pre>
+<ul>
+{{range .Files}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}{{end}}{{end}}
+</body>
+</html>
+`))
+
+// serveIndex serves an HTML page listing every module version the server
+// has, with its .info and .mod content and the files in its zip. Modules
+// matched by an AuthRule are only listed if req has credentials accepted
+// for them.
+func (s *Server) serveIndex(w http.ResponseWriter, req *http.Request) {
+	mvs, err := s.moduleVersions()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var mods []*indexModule
+	for _, mv := range mvs {
+		if s.authStatus(req, mv.Path) != http.StatusOK {
+			continue
+		}
+		if len(mods) == 0 || mods[len(mods)-1].Path != mv.Path {
+			mods = append(mods, &indexModule{Path: mv.Path})
+		}
+		mods[len(mods)-1].Versions = append(mods[len(mods)-1].Versions, s.indexVersion(mv))
+	}
+
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	if err := indexTemplate.Execute(w, mods); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func (s *Server) indexVersion(mv module.Version) indexVersion {
+	iv := indexVersion{Version: mv.Version}
+	escPath, err := module.EscapePath(mv.Path)
+	if err != nil {
+		iv.Err = err.Error()
+		return iv
+	}
+	escVersion, err := module.EscapeVersion(mv.Version)
+	if err != nil {
+		iv.Err = err.Error()
+		return iv
+	}
+	iv.URL = "/" + escPath + "/@v/" + escVersion
+
+	arc, err := s.archive(mv.Path, mv.Version)
+	if err != nil {
+		iv.Err = err.Error()
+		return iv
+	}
+	infoData, err := info(arc, mv.Path, mv.Version)
+	if err != nil {
+		iv.Err = err.Error()
+		return iv
+	}
+	modData, err := mod(arc, mv.Path)
+	if err != nil {
+		iv.Err = err.Error()
+		return iv
+	}
+	iv.Info = string(infoData)
+	iv.Mod = string(modData)
+	for _, f := range zipFiles(arc) {
+		iv.Files = append(iv.Files, f.Name)
+	}
+	return iv
+}
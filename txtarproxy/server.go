@@ -0,0 +1,541 @@
+// Package txtarproxy implements a Go module proxy that serves module
+// versions from txtar archives.
+//
+// Each archive in the root directory of the proxy's file system contains
+// a single module version and is named after the module path (with '/'
+// replaced by '_') and the version, for example,
+// "golang.org_x_mod_v0.4.2.txt". Files in the archive are named relative
+// to the module root directory. Files named .info and .mod are metadata:
+// they are served for .info and .mod requests but are not included in
+// the module zip.
+//
+// Module versions may also be read from multi-module bundle archives;
+// see NewServer.
+package txtarproxy
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/tools/txtar"
+)
+
+// Server is an http.Handler that implements the GOPROXY protocol.
+type Server struct {
+	// Upstream is the URL of a GOPROXY (http, https, or file) that requests
+	// are forwarded to when a module is not found in the server's archives.
+	// If empty, only local archives are served.
+	Upstream string
+
+	// RecordDir is a directory where modules fetched from Upstream are
+	// written as txtar archives, so they may be served offline later.
+	// If empty, modules are not recorded.
+	RecordDir string
+
+	// Auth is a list of rules requiring clients to authenticate before
+	// accessing matching modules. Modules not matched by any rule are public.
+	Auth []AuthRule
+
+	// RecordRequests indicates that every request handled should be kept in
+	// memory, so it can be retrieved with Requests and Paths. This is meant
+	// for tests; a long-running server should leave it unset.
+	RecordRequests bool
+
+	// AccessLog, if not nil, receives a JSON-encoded Request for each
+	// request handled, one per line.
+	AccessLog io.Writer
+
+	// Lax indicates that module versions with inconsistent metadata (for
+	// example, a go.mod file declaring a different module path) should be
+	// served with a warning instead of being rejected.
+	Lax bool
+
+	// ErrorLog receives warnings. If nil, the log package's standard logger
+	// is used.
+	ErrorLog *log.Logger
+
+	fsys fs.FS
+
+	// bundleNames are the names of bundle archives in fsys. These are
+	// skipped when looking for single-module archives.
+	bundleNames map[string]bool
+
+	mu sync.Mutex
+
+	// bundle contains module versions loaded from multi-module archives.
+	// These take precedence over single-module archives in fsys. bundle is
+	// guarded by mu; Reload replaces it, but it is not otherwise modified.
+	bundle map[module.Version]*txtar.Archive
+
+	// requests holds the requests handled, if RecordRequests is set. stats
+	// holds running counts of requests for /_stats; it's nil until the first
+	// request for a module. Both are guarded by mu.
+	requests []Request
+	stats    *Stats
+}
+
+// NewServer returns a Server that serves module versions from txtar archives
+// in the root directory of fsys.
+//
+// bundles are names of multi-module archives within fsys. Each file in a
+// bundle is named <module path>@<version>/<file name>, for example,
+// "example.com/a@v1.0.0/go.mod", which is the layout used by
+// cmd/go/testdata/mod. Bundles are indexed when the Server is created.
+func NewServer(fsys fs.FS, bundles ...string) (*Server, error) {
+	bundle, err := loadBundles(fsys, bundles)
+	if err != nil {
+		return nil, err
+	}
+	bundleNames := make(map[string]bool)
+	for _, name := range bundles {
+		bundleNames[name] = true
+	}
+	return &Server{fsys: fsys, bundle: bundle, bundleNames: bundleNames}, nil
+}
+
+// Reload re-reads the server's bundle archives. Single-module archives are
+// read on each request, so changes to them are visible without reloading.
+// If an error occurs, the server continues to serve the old bundles.
+func (s *Server) Reload() error {
+	names := make([]string, 0, len(s.bundleNames))
+	for name := range s.bundleNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	bundle, err := loadBundles(s.fsys, names)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bundle = bundle
+	return nil
+}
+
+// bundleIndex returns the current bundle index. The caller must not
+// modify it.
+func (s *Server) bundleIndex() map[module.Version]*txtar.Archive {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bundle
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/":
+		s.serveIndex(w, req)
+		return
+	case "/_stats":
+		s.serveStats(w, req)
+		return
+	}
+
+	start := time.Now()
+	rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+	r := Request{Time: start, Method: req.Method, Path: req.URL.Path}
+	r.Module, r.Version, r.Ext = s.serveProxy(rw, req)
+	r.Status = rw.status
+	r.Size = rw.size
+	r.Duration = time.Since(start)
+	s.logRequest(r)
+}
+
+// serveProxy handles a GOPROXY protocol request. It returns the module path,
+// version, and kind of file requested, if the request path could be parsed.
+func (s *Server) serveProxy(w http.ResponseWriter, req *http.Request) (modPath, version, ext string) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeStatus(w, http.StatusBadRequest)
+		return "", "", ""
+	}
+
+	modPath, version, ext, err := parsePath(req.URL.Path)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return "", "", ""
+	}
+	if code := s.authStatus(req, modPath); code != http.StatusOK {
+		s.writeAuthError(w, code, modPath)
+		return modPath, version, ext
+	}
+
+	data, err := s.get(modPath, version, ext)
+	if errors.Is(err, fs.ErrNotExist) && s.Upstream != "" {
+		data, err = s.getUpstream(req.URL.Path, modPath, version, ext)
+	}
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return modPath, version, ext
+	}
+	w.Header().Add("Content-Type", contentType(ext))
+	w.Write(data)
+	return modPath, version, ext
+}
+
+// get returns the content of a proxy file from s.bundle or archives in
+// s.fsys. If the module or version is not present, get returns an error
+// wrapping fs.ErrNotExist.
+func (s *Server) get(modPath, version, ext string) ([]byte, error) {
+	if ext == "latest" {
+		return nil, fmt.Errorf("%s@latest: %w", modPath, fs.ErrNotExist)
+	}
+	if ext == "list" {
+		return s.list(modPath)
+	}
+	arc, err := s.archive(modPath, version)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkArchive(arc, modPath, version); err != nil {
+		if !s.Lax {
+			return nil, err
+		}
+		s.logf("warning: %v", err)
+	}
+	return serveArchive(arc, modPath, version, ext)
+}
+
+// serveArchive returns the content of a .info, .mod, or .zip file for
+// a module version stored in arc.
+func serveArchive(arc *txtar.Archive, modPath, version, ext string) ([]byte, error) {
+	switch ext {
+	case "info":
+		return info(arc, modPath, version)
+	case "mod":
+		return mod(arc, modPath)
+	case "zip":
+		return zipArchive(arc, modPath, version)
+	default:
+		panic("unreachable")
+	}
+}
+
+// getUpstream returns the content of a proxy file from s.Upstream. If
+// s.RecordDir is set, the whole module version is saved as an archive there
+// first, then served from the saved archive.
+func (s *Server) getUpstream(urlPath, modPath, version, ext string) ([]byte, error) {
+	if s.RecordDir != "" && version != "" {
+		arc, err := s.recordModule(modPath, version)
+		if err != nil {
+			return nil, err
+		}
+		return serveArchive(arc, modPath, version, ext)
+	}
+	return s.fetchUpstream(urlPath)
+}
+
+func contentType(ext string) string {
+	switch ext {
+	case "info", "latest":
+		return "application/json"
+	case "zip":
+		return "application/zip"
+	default:
+		return "text/plain"
+	}
+}
+
+func (s *Server) list(modPath string) ([]byte, error) {
+	entries, err := fs.ReadDir(s.fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	seen := make(map[string]bool)
+	prefix := strings.ReplaceAll(modPath, "/", "_") + "_"
+	suffix := ".txt"
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		v := name[len(prefix) : len(name)-len(suffix)]
+		if !isCanonicalVersion(v) {
+			continue
+		}
+		seen[v] = true
+		buf.WriteString(v)
+		buf.WriteString("\n")
+	}
+
+	var bundleVersions []string
+	for mv := range s.bundleIndex() {
+		if mv.Path == modPath && !seen[mv.Version] {
+			seen[mv.Version] = true
+			bundleVersions = append(bundleVersions, mv.Version)
+		}
+	}
+	sort.Slice(bundleVersions, func(i, j int) bool {
+		return semver.Compare(bundleVersions[i], bundleVersions[j]) < 0
+	})
+	for _, v := range bundleVersions {
+		buf.WriteString(v)
+		buf.WriteString("\n")
+	}
+
+	if s.Upstream != "" {
+		escPath, err := module.EscapePath(modPath)
+		if err != nil {
+			return nil, err
+		}
+		upData, err := s.fetchUpstream("/" + escPath + "/@v/list")
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		for _, v := range strings.Fields(string(upData)) {
+			if !seen[v] {
+				seen[v] = true
+				buf.WriteString(v)
+				buf.WriteString("\n")
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// info returns the .info file for a module version. If the archive contains
+// a .info file, it's returned verbatim. Otherwise, the version's metadata is
+// read from "Key: value" lines in the archive comment. Recognized keys are
+// Time (in RFC 3339 format), VCS, URL, Hash, and Ref. If Time is not set,
+// the timestamp of a pseudo-version or defaultTime is used, so that
+// responses don't depend on file modification times.
+func info(arc *txtar.Archive, modPath, version string) ([]byte, error) {
+	if data, ok := findFile(arc, ".info"); ok {
+		return data, nil
+	}
+	rev, err := parseInfoComment(version, arc.Comment)
+	if err != nil {
+		return nil, fmt.Errorf("%s@%s: %w", modPath, version, err)
+	}
+	return json.Marshal(rev)
+}
+
+// revInfo is the content of a .info file.
+type revInfo struct {
+	Version string
+	Time    time.Time
+	Origin  *revOrigin `json:",omitempty"`
+}
+
+// revOrigin describes the repository a version was fetched from.
+type revOrigin struct {
+	VCS  string `json:",omitempty"`
+	URL  string `json:",omitempty"`
+	Hash string `json:",omitempty"`
+	Ref  string `json:",omitempty"`
+}
+
+// defaultTime is the timestamp reported for versions that don't specify one.
+var defaultTime = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func parseInfoComment(version string, comment []byte) (*revInfo, error) {
+	info := &revInfo{Version: version}
+	origin := &revOrigin{}
+	for _, line := range strings.Split(string(comment), "\n") {
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		key, value := line[:colon], strings.TrimSpace(line[colon+1:])
+		switch key {
+		case "Time":
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, err
+			}
+			info.Time = t.UTC()
+		case "VCS":
+			origin.VCS = value
+		case "URL":
+			origin.URL = value
+		case "Hash":
+			origin.Hash = value
+		case "Ref":
+			origin.Ref = value
+		}
+	}
+	if *origin != (revOrigin{}) {
+		info.Origin = origin
+	}
+	if info.Time.IsZero() {
+		if t, ok := pseudoVersionTime(version); ok {
+			info.Time = t
+		} else {
+			info.Time = defaultTime
+		}
+	}
+	return info, nil
+}
+
+var pseudoVersionRE = regexp.MustCompile(`^v[0-9]+\.(0\.0-|\d+\.\d+-([^+]*\.)?0\.)(\d{14})-[A-Za-z0-9]+(\+[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?$`)
+
+// pseudoVersionTime returns the timestamp embedded in a pseudo-version.
+func pseudoVersionTime(version string) (time.Time, bool) {
+	m := pseudoVersionRE.FindStringSubmatch(version)
+	if m == nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("20060102150405", m[3])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// mod returns the .mod file for a module version. A .mod file in the archive
+// takes precedence over go.mod, which may differ (for example, for
+// +incompatible versions). If neither is present, a minimal go.mod
+// is synthesized.
+func mod(arc *txtar.Archive, modPath string) ([]byte, error) {
+	if data, ok := findFile(arc, ".mod"); ok {
+		return data, nil
+	}
+	if data, ok := findFile(arc, "go.mod"); ok {
+		return data, nil
+	}
+	return []byte(fmt.Sprintf("module %s", modPath)), nil
+}
+
+// zipArchive returns the .zip file for a module version. The .info and .mod
+// files are metadata and are not included.
+func zipArchive(arc *txtar.Archive, modPath, version string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	z := zip.NewWriter(buf)
+	prefix := fmt.Sprintf("%s@%s/", modPath, version)
+	for _, f := range zipFiles(arc) {
+		name := prefix + f.Name
+		w, err := z.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = w.Write(f.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// archive returns the files of a module version, either from s.bundle or
+// from an archive in s.fsys. File names are relative to the module root.
+func (s *Server) archive(modPath, version string) (*txtar.Archive, error) {
+	if arc, ok := s.bundleIndex()[module.Version{Path: modPath, Version: version}]; ok {
+		return arc, nil
+	}
+	data, err := fs.ReadFile(s.fsys, fileName(modPath, version))
+	if err != nil {
+		return nil, err
+	}
+	return txtar.Parse(data), nil
+}
+
+// zipFiles returns the files in arc that belong in the module zip.
+func zipFiles(arc *txtar.Archive) []txtar.File {
+	var files []txtar.File
+	for _, f := range arc.Files {
+		if f.Name != ".info" && f.Name != ".mod" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func findFile(arc *txtar.Archive, name string) ([]byte, bool) {
+	for _, f := range arc.Files {
+		if f.Name == name {
+			return f.Data, true
+		}
+	}
+	return nil, false
+}
+
+// fileName returns the name of the archive containing a module version.
+func fileName(modPath, version string) string {
+	return strings.ReplaceAll(modPath, "/", "_") + "_" + version + ".txt"
+}
+
+func parsePath(path string) (modPath, version, ext string, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("parsing path %s: %w", path, err)
+		}
+	}()
+
+	if !strings.HasPrefix(path, "/") {
+		return "", "", "", errors.New("does not start with '/'")
+	}
+	rest := path[1:]
+	if strings.HasSuffix(rest, "/@latest") {
+		modPath = rest[:len(rest)-len("/@latest")]
+		ext = "latest"
+	} else if strings.HasSuffix(rest, "/@v/list") {
+		modPath = rest[:len(rest)-len("/@v/list")]
+		ext = "list"
+	} else {
+		at := strings.Index(rest, "/@v/")
+		if at < 0 {
+			return "", "", "", errors.New("does not contain '@'")
+		}
+		modPath = rest[:at]
+		rest = rest[at+len("/@v/"):]
+		dot := strings.LastIndex(rest, ".")
+		if dot < 0 {
+			return "", "", "", errors.New("does not have extension")
+		}
+		version = rest[:dot]
+		ext = rest[dot+1:]
+		if version, err = module.UnescapeVersion(version); err != nil {
+			return "", "", "", err
+		}
+		if version == "" {
+			return "", "", "", errors.New("version is empty")
+		}
+		if !isCanonicalVersion(version) {
+			return "", "", "", fmt.Errorf("version %q is not canonical", version)
+		}
+	}
+
+	if modPath, err = module.UnescapePath(modPath); err != nil {
+		return "", "", "", err
+	}
+	switch ext {
+	case "info", "latest", "list", "mod", "zip":
+	default:
+		return "", "", "", fmt.Errorf("invalid extension %q", ext)
+	}
+	return modPath, version, ext, nil
+}
+
+// isCanonicalVersion reports whether v is a canonical semantic version,
+// optionally with a +incompatible suffix. The go command uses +incompatible
+// for major versions 2 and higher of modules without a go.mod file;
+// checkArchive verifies that such versions are used correctly.
+func isCanonicalVersion(v string) bool {
+	c := semver.Canonical(v)
+	return c != "" && (v == c || v == c+"+incompatible")
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "%s: %v", http.StatusText(code), err)
+}
+
+func writeStatus(w http.ResponseWriter, code int) {
+	w.WriteHeader(code)
+	fmt.Fprint(w, http.StatusText(code))
+}
@@ -0,0 +1,446 @@
+package txtarproxy
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+var testFS = fstest.MapFS{
+	"example.com_a_v1.0.0.txt": {Data: []byte(`Time: 2020-01-02T03:04:05Z
+-- go.mod --
+module example.com/a
+-- a.go --
+package a
+`)},
+	"example.com_a_v1.1.0.txt": {Data: []byte(`-- .info --
+{"Version":"v1.1.0","Time":"2021-01-01T00:00:00Z"}
+-- .mod --
+module example.com/a
+
+go 1.16
+-- a.go --
+package a
+`)},
+	"bundle.txt": {Data: []byte(`-- example.com/b@v1.0.0/go.mod --
+module example.com/b
+-- example.com/b@v1.0.0/b.go --
+package b
+-- example.com/b@v0.0.0-20200304050607-abcdefabcdef/b.go --
+package b
+`)},
+}
+
+func TestServer(t *testing.T) {
+	s, err := NewServer(testFS, "bundle.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyURL := startServer(t, s)
+
+	for _, tt := range []struct {
+		path, want string
+	}{
+		{"/example.com/a/@v/list", "v1.0.0\nv1.1.0\n"},
+		{"/example.com/a/@v/v1.0.0.info", `{"Version":"v1.0.0","Time":"2020-01-02T03:04:05Z"}`},
+		{"/example.com/a/@v/v1.0.0.mod", "module example.com/a\n"},
+		{"/example.com/a/@v/v1.1.0.info", `{"Version":"v1.1.0","Time":"2021-01-01T00:00:00Z"}` + "\n"},
+		{"/example.com/a/@v/v1.1.0.mod", "module example.com/a\n\ngo 1.16\n"},
+		{"/example.com/b/@v/list", "v0.0.0-20200304050607-abcdefabcdef\nv1.0.0\n"},
+		{"/example.com/b/@v/v1.0.0.mod", "module example.com/b\n"},
+		{"/example.com/b/@v/v0.0.0-20200304050607-abcdefabcdef.info", `{"Version":"v0.0.0-20200304050607-abcdefabcdef","Time":"2020-03-04T05:06:07Z"}`},
+		{"/example.com/b/@v/v0.0.0-20200304050607-abcdefabcdef.mod", "module example.com/b"},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := get(t, proxyURL+tt.path, http.StatusOK); got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+
+	for _, path := range []string{
+		"/example.com/a/@latest",
+		"/example.com/a/@v/v1.2.0.info",
+		"/example.com/c/@v/v1.0.0.mod",
+		"/example.com/a/@v/v1.0.info",
+	} {
+		t.Run(path, func(t *testing.T) {
+			get(t, proxyURL+path, http.StatusNotFound)
+		})
+	}
+}
+
+func TestZip(t *testing.T) {
+	proxyURL, s := StartTestProxy(t, testFS)
+	data := get(t, proxyURL+"/example.com/a/@v/v1.1.0.zip", http.StatusOK)
+	if got, want := strings.Join(s.Paths(), ","), "/example.com/a/@v/v1.1.0.zip"; got != want {
+		t.Errorf("got paths %s; want %s", got, want)
+	}
+	zr, err := zip.NewReader(strings.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if got, want := strings.Join(names, ","), "example.com/a@v1.1.0/a.go"; got != want {
+		t.Errorf("got files %s; want %s", got, want)
+	}
+}
+
+func TestUpstream(t *testing.T) {
+	upstreamURL, upstream := StartTestProxy(t, testFS)
+	// Serve from the recording directory, as txtarmodserve -record does.
+	recordDir := t.TempDir()
+	proxyURL, s := StartTestProxy(t, os.DirFS(recordDir))
+	s.Upstream = upstreamURL
+	s.RecordDir = recordDir
+
+	if got, want := get(t, proxyURL+"/example.com/a/@v/list", http.StatusOK), "v1.0.0\nv1.1.0\n"; got != want {
+		t.Errorf("list: got %q; want %q", got, want)
+	}
+	if got, want := get(t, proxyURL+"/example.com/a/@v/v1.0.0.mod", http.StatusOK), "module example.com/a\n"; got != want {
+		t.Errorf("mod: got %q; want %q", got, want)
+	}
+	get(t, proxyURL+"/example.com/c/@v/v1.0.0.mod", http.StatusNotFound)
+
+	data, err := ioutil.ReadFile(filepath.Join(recordDir, "example.com_a_v1.0.0.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("-- .info --\n{\"Version\":\"v1.0.0\",\"Time\":\"2020-01-02T03:04:05Z\"}")) {
+		t.Errorf("recorded archive does not contain upstream .info:\n%s", data)
+	}
+
+	// Once recorded, a version is served without asking upstream again.
+	before := len(upstream.Paths())
+	get(t, proxyURL+"/example.com/a/@v/v1.0.0.mod", http.StatusOK)
+	if got := upstream.Paths()[before:]; len(got) != 0 {
+		t.Errorf("recorded version was fetched from upstream again: %v", got)
+	}
+	if got := len(s.Paths()); got != 4 {
+		t.Errorf("got %d requests to proxy; want 4", got)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	s, err := NewServer(testFS, "bundle.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Auth = []AuthRule{
+		{Pattern: "example.com/a", User: "alice", Password: "secret"},
+		{Pattern: "example.com/a", Token: "t0ken"},
+	}
+	proxyURL := startServer(t, s)
+
+	for _, tt := range []struct {
+		desc, path, auth string
+		wantStatus       int
+	}{
+		{"public", "/example.com/b/@v/list", "", http.StatusOK},
+		{"no_credentials", "/example.com/a/@v/list", "", http.StatusUnauthorized},
+		{"basic", "/example.com/a/@v/list", "Basic YWxpY2U6c2VjcmV0", http.StatusOK},
+		{"basic_wrong", "/example.com/a/@v/list", "Basic YWxpY2U6d3Jvbmc=", http.StatusForbidden},
+		{"bearer", "/example.com/a/@v/v1.0.0.mod", "Bearer t0ken", http.StatusOK},
+		{"bearer_wrong", "/example.com/a/@v/v1.0.0.mod", "Bearer nope", http.StatusForbidden},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, proxyURL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d; want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusUnauthorized && len(resp.Header["Www-Authenticate"]) != 2 {
+				t.Errorf("got WWW-Authenticate %q; want Basic and Bearer", resp.Header["Www-Authenticate"])
+			}
+		})
+	}
+
+	// Protected modules are only listed for clients with credentials.
+	for _, tt := range []struct {
+		desc, path, auth string
+		wantA            bool
+	}{
+		{"index_no_credentials", "/", "", false},
+		{"index_wrong_credentials", "/", "Bearer nope", false},
+		{"index_credentials", "/", "Bearer t0ken", true},
+		{"stats_no_credentials", "/_stats", "", false},
+		{"stats_credentials", "/_stats", "Basic YWxpY2U6c2VjcmV0", true},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, proxyURL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			data, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d; want %d", resp.StatusCode, http.StatusOK)
+			}
+			if got := strings.Contains(string(data), "example.com/a"); got != tt.wantA {
+				t.Errorf("response mentions example.com/a: %v; want %v\n%s", got, tt.wantA, data)
+			}
+			if tt.path == "/" && !strings.Contains(string(data), "example.com/b") {
+				t.Errorf("index does not list public module example.com/b\n%s", data)
+			}
+		})
+	}
+}
+
+func TestIndex(t *testing.T) {
+	s, err := NewServer(testFS, "bundle.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := get(t, startServer(t, s)+"/", http.StatusOK)
+	for _, want := range []string{
+		`<h2 id="example.com/a">`,
+		`<a href="/example.com/a/@v/v1.1.0.zip">`,
+		`<a href="/example.com/b/@v/v0.0.0-20200304050607-abcdefabcdef.mod">`,
+		"<li>b.go</li>",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("index page does not contain %q", want)
+		}
+	}
+	if strings.Contains(page, "bundle.txt") {
+		t.Errorf("index page lists bundle archive as a module")
+	}
+}
+
+func TestRequests(t *testing.T) {
+	s, err := NewServer(testFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RecordRequests = true
+	logBuf := &bytes.Buffer{}
+	s.AccessLog = logBuf
+	proxyURL := startServer(t, s)
+
+	get(t, proxyURL+"/example.com/a/@v/list", http.StatusOK)
+	get(t, proxyURL+"/example.com/a/@v/v1.0.0.mod", http.StatusOK)
+	get(t, proxyURL+"/example.com/a/@v/v1.2.0.mod", http.StatusNotFound)
+	get(t, proxyURL+"/_stats", http.StatusOK)
+
+	want := []string{"/example.com/a/@v/list", "/example.com/a/@v/v1.0.0.mod", "/example.com/a/@v/v1.2.0.mod"}
+	if got := s.Paths(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Paths: got %q; want %q", got, want)
+	}
+	if n := strings.Count(logBuf.String(), "\n"); n != len(want) {
+		t.Errorf("access log has %d lines; want %d:\n%s", n, len(want), logBuf.String())
+	}
+	stats := s.Stats()
+	if got := stats.Modules["example.com/a"]["mod"]; got != 2 {
+		t.Errorf("Stats: got %d mod requests; want 2", got)
+	}
+	if got := stats.Latency["list"].Count; got != 1 {
+		t.Errorf("Stats: got %d list latencies; want 1", got)
+	}
+
+	s.ResetRequests()
+	if got := s.Requests(); len(got) != 0 {
+		t.Errorf("after ResetRequests, got %d requests; want 0", len(got))
+	}
+	if got := len(s.Stats().Modules); got != 0 {
+		t.Errorf("after ResetRequests, got stats for %d modules; want 0", got)
+	}
+
+	// Without RecordRequests, requests are counted but not kept.
+	s.RecordRequests = false
+	get(t, proxyURL+"/example.com/a/@v/list", http.StatusOK)
+	if got := s.Requests(); len(got) != 0 {
+		t.Errorf("without RecordRequests, got %d requests; want 0", len(got))
+	}
+	if got := s.Stats().Modules["example.com/a"]["list"]; got != 1 {
+		t.Errorf("without RecordRequests, got %d list requests in Stats; want 1", got)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	badFS := fstest.MapFS{
+		"example.com_good_v1.0.0.txt":  {Data: []byte("-- go.mod --\nmodule example.com/good\n")},
+		"example.com_wrong_v1.0.0.txt": {Data: []byte("-- go.mod --\nmodule example.com/other\n")},
+		"example.com_a_v2_v1.0.0.txt":  {Data: []byte("-- go.mod --\nmodule example.com/a/v2\n")},
+		"example.com_b_v2.0.0.txt":     {Data: []byte("-- go.mod --\nmodule example.com/b\n")},
+	}
+	s, err := NewServer(badFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []string
+	for _, err := range s.Check() {
+		msgs = append(msgs, err.Error())
+	}
+	got := strings.Join(msgs, "\n")
+	for _, want := range []string{
+		"example.com/a/v2@v1.0.0: ",
+		"example.com/b@v2.0.0: ",
+		"example.com/wrong@v1.0.0: go.mod declares module path example.com/other",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Check errors do not contain %q:\n%s", want, got)
+		}
+	}
+	if len(msgs) != 3 {
+		t.Errorf("got %d errors; want 3:\n%s", len(msgs), got)
+	}
+
+	proxyURL := startServer(t, s)
+	get(t, proxyURL+"/example.com/good/@v/v1.0.0.mod", http.StatusOK)
+	get(t, proxyURL+"/example.com/wrong/@v/v1.0.0.mod", http.StatusNotFound)
+
+	s.Lax = true
+	s.ErrorLog = log.New(ioutil.Discard, "", 0)
+	get(t, proxyURL+"/example.com/wrong/@v/v1.0.0.mod", http.StatusOK)
+}
+
+func TestIncompatible(t *testing.T) {
+	fsys := fstest.MapFS{
+		"example.com_c_v2.0.0+incompatible.txt":   {Data: []byte("-- c.go --\npackage c\n")},
+		"example.com_c_v1.0.0.txt":                {Data: []byte("-- c.go --\npackage c\n")},
+		"example.com_d_v2.0.0+incompatible.txt":   {Data: []byte("-- .mod --\nmodule example.com/d\n-- d.go --\npackage d\n")},
+		"example.com_bad_v2.0.0+incompatible.txt": {Data: []byte("-- go.mod --\nmodule example.com/bad\n")},
+		"example.com_c_v2.0.0+meta.txt":           {Data: []byte("-- c.go --\npackage c\n")},
+		"bundle.txt":                              {Data: []byte("-- example.com/e@v3.0.0+incompatible/e.go --\npackage e\n")},
+	}
+	s, err := NewServer(fsys, "bundle.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyURL := startServer(t, s)
+
+	for _, tt := range []struct {
+		path, want string
+	}{
+		{"/example.com/c/@v/list", "v1.0.0\nv2.0.0+incompatible\n"},
+		{"/example.com/c/@v/v2.0.0+incompatible.mod", "module example.com/c"},
+		{"/example.com/d/@v/v2.0.0+incompatible.mod", "module example.com/d\n"},
+		{"/example.com/e/@v/list", "v3.0.0+incompatible\n"},
+		{"/example.com/e/@v/v3.0.0+incompatible.mod", "module example.com/e"},
+	} {
+		if got := get(t, proxyURL+tt.path, http.StatusOK); got != tt.want {
+			t.Errorf("%s: got %q; want %q", tt.path, got, tt.want)
+		}
+	}
+	get(t, proxyURL+"/example.com/c/@v/v2.0.0+incompatible.zip", http.StatusOK)
+	get(t, proxyURL+"/example.com/c/@v/v2.0.0+meta.mod", http.StatusNotFound)
+	get(t, proxyURL+"/example.com/bad/@v/v2.0.0+incompatible.mod", http.StatusNotFound)
+
+	var msgs []string
+	for _, err := range s.Check() {
+		msgs = append(msgs, err.Error())
+	}
+	if got, want := strings.Join(msgs, "\n"), "example.com/bad@v2.0.0+incompatible: version is +incompatible, but module has a go.mod file"; got != want {
+		t.Errorf("Check: got errors:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestReload(t *testing.T) {
+	fsys := fstest.MapFS{
+		"bundle.txt": {Data: []byte("-- example.com/c@v1.0.0/go.mod --\nmodule example.com/c\n")},
+	}
+	s, err := NewServer(fsys, "bundle.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyURL := startServer(t, s)
+	if got, want := get(t, proxyURL+"/example.com/c/@v/list", http.StatusOK), "v1.0.0\n"; got != want {
+		t.Errorf("before reload: got %q; want %q", got, want)
+	}
+
+	fsys["bundle.txt"] = &fstest.MapFile{Data: []byte("-- example.com/c@v1.1.0/go.mod --\nmodule example.com/c\n")}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := get(t, proxyURL+"/example.com/c/@v/list", http.StatusOK), "v1.1.0\n"; got != want {
+		t.Errorf("after reload: got %q; want %q", got, want)
+	}
+
+	fsys["bundle.txt"] = &fstest.MapFile{Data: []byte("-- bad --\n")}
+	if err := s.Reload(); err == nil {
+		t.Error("Reload of invalid bundle succeeded")
+	}
+	get(t, proxyURL+"/example.com/c/@v/v1.1.0.mod", http.StatusOK)
+}
+
+func TestExport(t *testing.T) {
+	s, err := NewServer(testFS, "bundle.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := s.Export(dir); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		"cache/download/example.com/a/@v/list":        "v1.0.0\nv1.1.0\n",
+		"cache/download/example.com/a/@v/v1.1.0.mod":  "module example.com/a\n\ngo 1.16\n",
+		"cache/download/example.com/b/@v/list":        "v0.0.0-20200304050607-abcdefabcdef\nv1.0.0\n",
+		"cache/download/example.com/b/@v/v1.0.0.info": `{"Version":"v1.0.0","Time":"2019-01-01T00:00:00Z"}`,
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(path)))
+		if err != nil {
+			t.Error(err)
+		} else if got := string(data); got != want {
+			t.Errorf("%s: got %q; want %q", path, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cache/download/example.com/a/@v/v1.0.0.zip")); err != nil {
+		t.Error(err)
+	}
+}
+
+func startServer(t *testing.T, s *Server) string {
+	t.Helper()
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func get(t *testing.T, url string, wantStatus int) string {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != wantStatus {
+		t.Fatalf("GET %s: got status %d; want %d\n%s", url, resp.StatusCode, wantStatus, data)
+	}
+	return string(data)
+}
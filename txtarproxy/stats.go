@@ -0,0 +1,216 @@
+package txtarproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// A Request records a request handled by a Server. Requests are written to
+// Server.AccessLog and may be retrieved with Server.Requests.
+type Request struct {
+	Time   time.Time
+	Method string
+
+	// Path is the escaped URL path of the request.
+	Path string
+
+	// Module, Version, and Ext identify the file requested, if Path could be
+	// parsed. Ext is one of "list", "latest", "info", "mod", or "zip".
+	Module  string `json:",omitempty"`
+	Version string `json:",omitempty"`
+	Ext     string `json:",omitempty"`
+
+	// Status is the HTTP status code of the response, and Size is the number
+	// of bytes in the response body.
+	Status int
+	Size   int
+
+	// Duration is the time taken to handle the request. It's encoded in JSON
+	// as a number of nanoseconds.
+	Duration time.Duration
+}
+
+// Requests returns the requests handled by the server so far, in the order
+// they completed. Requests are only kept if RecordRequests is set. Requests
+// for the index page and /_stats are not included.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Paths returns the URL paths requested so far, in the order the requests
+// completed. Requests are only kept if RecordRequests is set. Tests may use
+// this to check exactly which files the go command fetched.
+func (s *Server) Paths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths := make([]string, len(s.requests))
+	for i, r := range s.requests {
+		paths[i] = r.Path
+	}
+	return paths
+}
+
+// ResetRequests clears the list of requests returned by Requests and Paths
+// and the counts reported by /_stats.
+func (s *Server) ResetRequests() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = nil
+	s.stats = nil
+}
+
+func (s *Server) logRequest(r Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.RecordRequests {
+		s.requests = append(s.requests, r)
+	}
+	if r.Module != "" {
+		if s.stats == nil {
+			s.stats = newStats()
+		}
+		s.stats.add(r)
+	}
+	if s.AccessLog != nil {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return
+		}
+		s.AccessLog.Write(append(data, '\n'))
+	}
+}
+
+// Stats summarizes the requests handled by a Server. It's served as JSON
+// at /_stats.
+type Stats struct {
+	// Modules maps each module path to the number of requests for each
+	// kind of file ("list", "info", "mod", and so on).
+	Modules map[string]map[string]int
+
+	// Latency maps each kind of file to a histogram of request durations.
+	Latency map[string]*Histogram
+}
+
+// A Histogram counts request durations in buckets.
+type Histogram struct {
+	Count int
+	Sum   time.Duration
+
+	// Buckets holds the number of requests with durations at or below each
+	// bound in latencyBounds, plus a final bucket for longer requests.
+	// Counts are not cumulative.
+	Buckets []Bucket
+}
+
+// A Bucket is a range of durations in a Histogram.
+type Bucket struct {
+	// LE is the upper bound of the bucket, like "10ms", or "+Inf".
+	LE    string
+	Count int
+}
+
+var latencyBounds = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// Stats returns a summary of the requests handled so far. Stats are kept
+// as running counts, whether or not RecordRequests is set.
+func (s *Server) Stats() *Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := newStats()
+	if s.stats == nil {
+		return stats
+	}
+	for modPath, counts := range s.stats.Modules {
+		stats.Modules[modPath] = make(map[string]int)
+		for ext, n := range counts {
+			stats.Modules[modPath][ext] = n
+		}
+	}
+	for ext, h := range s.stats.Latency {
+		hc := *h
+		hc.Buckets = append([]Bucket(nil), h.Buckets...)
+		stats.Latency[ext] = &hc
+	}
+	return stats
+}
+
+func newStats() *Stats {
+	return &Stats{
+		Modules: make(map[string]map[string]int),
+		Latency: make(map[string]*Histogram),
+	}
+}
+
+// add counts r in stats.
+func (stats *Stats) add(r Request) {
+	if stats.Modules[r.Module] == nil {
+		stats.Modules[r.Module] = make(map[string]int)
+	}
+	stats.Modules[r.Module][r.Ext]++
+
+	h := stats.Latency[r.Ext]
+	if h == nil {
+		h = &Histogram{Buckets: make([]Bucket, len(latencyBounds)+1)}
+		for i, b := range latencyBounds {
+			h.Buckets[i].LE = b.String()
+		}
+		h.Buckets[len(latencyBounds)].LE = "+Inf"
+		stats.Latency[r.Ext] = h
+	}
+	h.Count++
+	h.Sum += r.Duration
+	i := 0
+	for i < len(latencyBounds) && r.Duration > latencyBounds[i] {
+		i++
+	}
+	h.Buckets[i].Count++
+}
+
+// serveStats serves Stats as JSON. Counts for modules matched by an
+// AuthRule are only included if req has credentials accepted for them.
+func (s *Server) serveStats(w http.ResponseWriter, req *http.Request) {
+	stats := s.Stats()
+	for modPath := range stats.Modules {
+		if s.authStatus(req, modPath) != http.StatusOK {
+			delete(stats.Modules, modPath)
+		}
+	}
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// responseWriter wraps an http.ResponseWriter, recording the status code
+// and number of bytes written.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	w.size += n
+	return n, err
+}
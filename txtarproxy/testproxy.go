@@ -0,0 +1,24 @@
+package txtarproxy
+
+import (
+	"io/fs"
+	"net/http/httptest"
+	"testing"
+)
+
+// StartTestProxy starts a module proxy serving archives from fsys on a
+// local port. It returns the proxy's URL, suitable for use as GOPROXY, and
+// the Server, so tests may configure it further or check its Paths. The
+// proxy is stopped when the test and its subtests complete. The proxy
+// records requests, as if RecordRequests were set.
+func StartTestProxy(t testing.TB, fsys fs.FS) (string, *Server) {
+	t.Helper()
+	s, err := NewServer(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RecordRequests = true
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return srv.URL, s
+}
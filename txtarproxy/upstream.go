@@ -0,0 +1,115 @@
+package txtarproxy
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/jayconrod/misc/internal/atomicfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/tools/txtar"
+)
+
+// fetchUpstream retrieves a file from s.Upstream. urlPath is the escaped
+// path of the file relative to the proxy root, for example,
+// "/golang.org/x/mod/@v/list". If the upstream proxy does not have the file,
+// fetchUpstream returns an error wrapping fs.ErrNotExist.
+func (s *Server) fetchUpstream(urlPath string) ([]byte, error) {
+	u, err := url.Parse(s.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "file" {
+		return ioutil.ReadFile(filepath.Join(filepath.FromSlash(u.Path), filepath.FromSlash(urlPath)))
+	}
+
+	fetchURL := strings.TrimSuffix(s.Upstream, "/") + urlPath
+	resp, err := http.Get(fetchURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return ioutil.ReadAll(resp.Body)
+	case http.StatusNotFound, http.StatusGone:
+		return nil, fmt.Errorf("fetching %s: %s: %w", fetchURL, resp.Status, fs.ErrNotExist)
+	default:
+		return nil, fmt.Errorf("fetching %s: %s", fetchURL, resp.Status)
+	}
+}
+
+// recordModule fetches the .info, .mod, and .zip files for a module version
+// from s.Upstream and saves them as a txtar archive in s.RecordDir. The .info
+// and .mod files are saved verbatim as archive entries of the same name.
+func (s *Server) recordModule(modPath, version string) (arc *txtar.Archive, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("recording %s@%s: %w", modPath, version, err)
+		}
+	}()
+
+	escPath, err := module.EscapePath(modPath)
+	if err != nil {
+		return nil, err
+	}
+	escVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	base := "/" + escPath + "/@v/" + escVersion
+
+	infoData, err := s.fetchUpstream(base + ".info")
+	if err != nil {
+		return nil, err
+	}
+	modData, err := s.fetchUpstream(base + ".mod")
+	if err != nil {
+		return nil, err
+	}
+	zipData, err := s.fetchUpstream(base + ".zip")
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		return nil, err
+	}
+
+	arc = &txtar.Archive{
+		Files: []txtar.File{
+			{Name: ".info", Data: infoData},
+			{Name: ".mod", Data: modData},
+		},
+	}
+	prefix := fmt.Sprintf("%s@%s/", modPath, version)
+	for _, zf := range zr.File {
+		if strings.HasSuffix(zf.Name, "/") {
+			continue
+		}
+		if !strings.HasPrefix(zf.Name, prefix) {
+			return nil, fmt.Errorf("zip file %s does not have prefix %s", zf.Name, prefix)
+		}
+		r, err := zf.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		arc.Files = append(arc.Files, txtar.File{Name: zf.Name[len(prefix):], Data: data})
+	}
+
+	if err := atomicfile.WriteFile(filepath.Join(s.RecordDir, fileName(modPath, version)), txtar.Format(arc)); err != nil {
+		return nil, err
+	}
+	return arc, nil
+}